@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mount point of the unified cgroup hierarchy
+const CGROUP_ROOT = "/sys/fs/cgroup"
+
+// controllers enabled for the cgroups of commands
+const CGROUP_CONTROLLERS = "+memory +cpu +pids"
+
+// period of cpu.max, the quota is a share of it
+const CGROUP_CPU_PERIOD_US = 100000
+
+// The cgroup v2 the server runs in, every command with limits gets a
+// child cgroup of it
+type Cgroups struct {
+	Path    string
+	mu      sync.Mutex
+	enabled bool
+}
+
+// find the server's own cgroup, fails unless it is a writable cgroup v2
+func DetectCgroups() (*Cgroups, error) {
+	if _, err := os.Stat(filepath.Join(CGROUP_ROOT, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s", CGROUP_ROOT)
+	}
+
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if rest, found := strings.CutPrefix(line, "0::"); found {
+			path := filepath.Join(CGROUP_ROOT, rest)
+			if err := unix.Access(path, unix.W_OK); err != nil {
+				return nil, fmt.Errorf("cgroup %s is not writable: %w", path, err)
+			}
+			return &Cgroups{Path: path}, nil
+		}
+	}
+	return nil, fmt.Errorf("no cgroup v2 entry in /proc/self/cgroup")
+}
+
+// Enable the controllers for child cgroups. A cgroup with processes cannot
+// hand controllers to its children, so the server moves into a `server`
+// leaf cgroup first if it has to. It never moves processes it does not own.
+func (c *Cgroups) enable() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.enabled {
+		return nil
+	}
+
+	subtreeControl := filepath.Join(c.Path, "cgroup.subtree_control")
+	err := os.WriteFile(subtreeControl, []byte(CGROUP_CONTROLLERS), 0)
+	if errors.Is(err, unix.EBUSY) {
+		if err := c.moveSelfToLeaf("server"); err != nil {
+			return err
+		}
+		err = os.WriteFile(subtreeControl, []byte(CGROUP_CONTROLLERS), 0)
+	}
+	if err != nil {
+		return fmt.Errorf("enable cgroup controllers: %w", err)
+	}
+
+	c.enabled = true
+	return nil
+}
+
+// move the server into the child cgroup `name`, fails if the cgroup holds
+// other processes as well, it was not delegated to the server then
+func (c *Cgroups) moveSelfToLeaf(name string) error {
+	data, err := os.ReadFile(filepath.Join(c.Path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	self := strconv.Itoa(os.Getpid())
+	others := []string{}
+	for pid := range strings.FieldsSeq(string(data)) {
+		if pid != self {
+			others = append(others, pid)
+		}
+	}
+	if len(others) > 0 {
+		return fmt.Errorf(
+			"cgroup %s not delegated, it also holds processes %s",
+			c.Path, strings.Join(others, " "),
+		)
+	}
+
+	leaf := filepath.Join(c.Path, name)
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(self), 0); err != nil {
+		return fmt.Errorf("move the server to cgroup %s: %w", leaf, err)
+	}
+	slog.Info("moved the server into a leaf cgroup to enable controllers", "from", c.Path, "to", leaf)
+	return nil
+}
+
+// Cgroup of a single command
+type Cgroup struct {
+	Path string
+	dir  *os.File
+}
+
+// create the cgroup of command `id` with `limits` applied
+func (c *Cgroups) New(id string, limits *Limits) (*Cgroup, error) {
+	if err := c.enable(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(c.Path, "command-"+id)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+	cgroup := &Cgroup{Path: path}
+
+	settings := [][2]string{}
+	if limits.MemoryBytes > 0 {
+		settings = append(settings,
+			[2]string{"memory.max", strconv.FormatInt(limits.MemoryBytes, 10)},
+			// without swap the limit ends in an oom kill instead of swapping
+			[2]string{"memory.swap.max", "0"},
+		)
+	}
+	if limits.Cpus > 0 {
+		quota := int64(limits.Cpus * CGROUP_CPU_PERIOD_US)
+		settings = append(settings, [2]string{"cpu.max", fmt.Sprintf("%d %d", quota, CGROUP_CPU_PERIOD_US)})
+	}
+	if limits.MaxProcesses > 0 {
+		settings = append(settings, [2]string{"pids.max", strconv.FormatInt(limits.MaxProcesses, 10)})
+	}
+
+	for _, setting := range settings {
+		err := os.WriteFile(filepath.Join(path, setting[0]), []byte(setting[1]), 0)
+		// memory.swap.max is missing on kernels without swap accounting
+		if err != nil && !(setting[0] == "memory.swap.max" && os.IsNotExist(err)) {
+			cgroup.Remove()
+			return nil, fmt.Errorf("set %s: %w", setting[0], err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cgroup.Remove()
+		return nil, err
+	}
+	cgroup.dir = dir
+	return cgroup, nil
+}
+
+// file descriptor to start the process in the cgroup with, see SysProcAttr.CgroupFD
+func (g *Cgroup) Fd() int {
+	return int(g.dir.Fd())
+}
+
+// whether the kernel killed a process of the cgroup for exceeding memory.max
+func (g *Cgroup) OOMKilled() bool {
+	file, err := os.Open(filepath.Join(g.Path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "oom_kill "); found {
+			n, _ := strconv.Atoi(value)
+			return n > 0
+		}
+	}
+	return false
+}
+
+// remove the cgroup, fails while processes that left the group still run in it
+func (g *Cgroup) Remove() error {
+	if g.dir != nil {
+		g.dir.Close()
+	}
+	return os.Remove(g.Path)
+}
@@ -6,11 +6,14 @@ const (
 	COMMAND_CREATE CommandEventType = "create"
 	COMMAND_UPDATE CommandEventType = "update"
 	COMMAND_DELETE CommandEventType = "delete"
+	// carries only the id and `progress` of a running command
+	COMMAND_PROGRESS CommandEventType = "progress"
 )
 
 type CommandEvent struct {
 	*Command
 	Type CommandEventType `json:"type"`
+	Progress *Progress `json:"progress,omitempty"`
 }
 
 func CommandMessage(command *Command, ty CommandEventType) *CommandEvent {
@@ -19,3 +22,11 @@ func CommandMessage(command *Command, ty CommandEventType) *CommandEvent {
 		Type: ty,
 	}
 }
+
+func ProgressMessage(id string, progress *Progress) *CommandEvent {
+	return &CommandEvent{
+		Command: &Command{Id: id},
+		Type: COMMAND_PROGRESS,
+		Progress: progress,
+	}
+}
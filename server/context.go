@@ -5,19 +5,32 @@ import "github.com/labstack/echo/v4"
 type CockpitContext struct {
 	echo.Context
 
-	Runner Runner
-	DB     DB
-	Bus    *EventBus
+	Runner     Runner
+	DB         DB
+	Bus        *EventBus
+	Dispatcher *Dispatcher
+	Scheduler  *Scheduler
+	Janitor    *Janitor
 }
 
-func CockpitContextMiddleware(runner Runner, db DB, bus *EventBus) echo.MiddlewareFunc {
+func CockpitContextMiddleware(
+	runner Runner,
+	db DB,
+	bus *EventBus,
+	dispatcher *Dispatcher,
+	scheduler *Scheduler,
+	janitor *Janitor,
+) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			cc := &CockpitContext{
-				Context: c,
-				Runner:  runner,
-				DB:      db,
-				Bus:     bus,
+				Context:    c,
+				Runner:     runner,
+				DB:         db,
+				Bus:        bus,
+				Dispatcher: dispatcher,
+				Scheduler:  scheduler,
+				Janitor:    janitor,
 			}
 			return next(cc)
 		}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed five field cron expression: minute hour day-of-month month day-of-week.
+// Each field is a bitset of the values it matches.
+type Cron struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// day-of-month and day-of-week match if either does when both are restricted,
+	// a field starting with `*` like `*/2` is not restricted, like in vixie cron
+	domAny bool
+	dowAny bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var CRON_FIELDS = [5]cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}},
+	// 7 is accepted as sunday and folded into 0
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}},
+}
+
+var CRON_MACROS = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse cron expression like `30 3 * * 1-5`, `*/15 * * * *` or `@daily`
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, found := CRON_MACROS[strings.ToLower(expr)]; found {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(CRON_FIELDS) {
+		return nil, fmt.Errorf("cron expression needs %d fields, got %d", len(CRON_FIELDS), len(fields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseCronField(field, CRON_FIELDS[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+
+	// fold sunday as 7 into 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	return &Cron{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for part := range strings.SplitSeq(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepPart, spec.name)
+			}
+			step = n
+		}
+
+		var lo, hi int
+		if rangePart == "*" {
+			lo, hi = spec.min, spec.max
+		} else if a, b, isRange := strings.Cut(rangePart, "-"); isRange {
+			var err error
+			if lo, err = parseCronValue(a, spec); err != nil {
+				return 0, err
+			}
+			if hi, err = parseCronValue(b, spec); err != nil {
+				return 0, err
+			}
+		} else {
+			var err error
+			if lo, err = parseCronValue(rangePart, spec); err != nil {
+				return 0, err
+			}
+			hi = lo
+			// `5/15` means from 5 to the end in steps of 15
+			if hasStep {
+				hi = spec.max
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %q in %s field", rangePart, spec.name)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, spec cronField) (int, error) {
+	if n, found := spec.names[strings.ToUpper(value)]; found {
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < spec.min || n > spec.max {
+		return 0, fmt.Errorf("invalid value %q in %s field", value, spec.name)
+	}
+	return n, nil
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// first time strictly after `t` matching the expression, in `t`'s location.
+// returns the zero time if nothing matches within five years, like `0 0 30 2 *`
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	from := time.Date(2025, time.March, 14, 10, 7, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.March, 14, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2025, time.March, 15, 3, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, time.April, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2025, time.March, 17, 9, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2025, time.March, 16, 12, 0, 0, 0, time.UTC)},
+		{"0 0 13,20 * fri", time.Date(2025, time.March, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		// odd days that are mondays, not every odd day or monday
+		{"0 0 */2 * 1", time.Date(2025, time.March, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", time.Date(2025, time.April, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) error: %s\n", c.expr, err)
+			continue
+		}
+		if next := cron.Next(from); !next.Equal(c.next) {
+			t.Errorf("ParseCron(%q).Next = %s, expected %s\n", c.expr, next, c.next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) expected error\n", expr)
+		}
+	}
+
+	cron, _ := ParseCron("0 0 30 2 *")
+	if next := cron.Next(from); !next.IsZero() {
+		t.Errorf("expected no next run for feb 30, got %s\n", next)
+	}
+}
@@ -3,7 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -16,21 +21,166 @@ const (
 	COMMAND_RUNNING CommandStatus = "RUNNING"
 	COMMAND_EXITED  CommandStatus = "EXITED"
 	COMMAND_ERROR   CommandStatus = "ERROR"
+	// stopped because it ran past its timeout or deadline
+	COMMAND_TIMED_OUT CommandStatus = "TIMED_OUT"
+	// the server restarted while the command was running or waiting to run
+	COMMAND_LOST CommandStatus = "LOST"
+	// waiting for a free slot in its queue
+	COMMAND_QUEUED CommandStatus = "QUEUED"
+	// removed from its queue or workflow before it started
+	COMMAND_CANCELED CommandStatus = "CANCELED"
+	// process group stopped with SIGSTOP until it receives SIGCONT
+	COMMAND_PAUSED CommandStatus = "PAUSED"
+	// workflow node waiting for its dependencies to finish
+	COMMAND_PENDING CommandStatus = "PENDING"
+	// workflow node not run because the conditions on its dependencies were not met
+	COMMAND_SKIPPED CommandStatus = "SKIPPED"
 )
 
+var COMMAND_STATUSES = []CommandStatus{
+	COMMAND_IDLE, COMMAND_RUNNING, COMMAND_EXITED, COMMAND_ERROR, COMMAND_TIMED_OUT, COMMAND_LOST,
+	COMMAND_QUEUED, COMMAND_CANCELED, COMMAND_PAUSED, COMMAND_PENDING, COMMAND_SKIPPED,
+}
+
+// why a command was killed, nil when it exited on its own
+type TermReason string
+
+const (
+	TERM_STOPPED TermReason = "stopped"
+	TERM_TIMEOUT TermReason = "timeout"
+	// killed by the kernel for exceeding its memory limit
+	TERM_OOM TermReason = "oom"
+)
+
+// whether a command in this status will never run again
+func (s CommandStatus) IsFinished() bool {
+	switch s {
+	case COMMAND_EXITED, COMMAND_ERROR, COMMAND_TIMED_OUT, COMMAND_LOST, COMMAND_CANCELED, COMMAND_SKIPPED:
+		return true
+	}
+	return false
+}
+
+// whether a command in this status ran and did not succeed
+func (s CommandStatus) IsFailed() bool {
+	switch s {
+	case COMMAND_ERROR, COMMAND_TIMED_OUT, COMMAND_LOST:
+		return true
+	}
+	return false
+}
+
 type LogFD int
 
 const (
 	LOG_STDOUT LogFD = 1
 	LOG_STDERR LogFD = 2
 	LOG_ERROR  LogFD = -1
+	// input written to the command's stdin
+	LOG_STDIN LogFD = 0
 )
 
 type Command struct {
-	Id        string        `json:"id"`
-	CreatedAt string        `json:"createdAt"`
-	Command   string        `json:"command"`
-	Status    CommandStatus `json:"status"`
+	Id         string        `json:"id"`
+	CreatedAt  string        `json:"createdAt"`
+	Command    string        `json:"command"`
+	Status     CommandStatus `json:"status"`
+	ExitCode   *int          `json:"exitCode"`
+	TermSignal *int          `json:"termSignal"`
+	StartedAt  *string       `json:"startedAt"`
+	FinishedAt *string       `json:"finishedAt"`
+	DurationMs *int64        `json:"durationMs"`
+	TimeoutMs  *int64        `json:"timeoutMs"`
+	Deadline   *string       `json:"deadline"`
+	Cwd        string        `json:"cwd"`
+	Env        CommandEnv    `json:"env"`
+	Pid        *int          `json:"pid"`
+	Pgid       *int          `json:"pgid"`
+	// name of the queue the command waits in, empty when it runs immediately
+	Queue         string `json:"queue"`
+	QueuePosition *int64 `json:"queuePosition"`
+	// command this one is a rerun of
+	RerunOf *string      `json:"rerunOf"`
+	Retry   *RetryPolicy `json:"retry"`
+	// 1 for the first run, counts up with every automatic retry
+	Attempt int `json:"attempt"`
+	// run under a pseudo terminal of `TtyRows` x `TtyCols` instead of pipes
+	Tty     bool `json:"tty"`
+	TtyRows *int `json:"ttyRows"`
+	TtyCols *int `json:"ttyCols"`
+	// keep stdin open for input, otherwise it reads from /dev/null.
+	// always true for tty commands
+	Stdin bool `json:"stdin"`
+	// largest resident set size of the process group in bytes, set once it finished
+	PeakRss *int64 `json:"peakRss"`
+	// resource limits applied by the runner
+	Limits     *Limits     `json:"limits"`
+	TermReason *TermReason `json:"termReason"`
+	// how `Command` is executed, nil runs it in DEFAULT_SHELL
+	Exec *ExecSpec `json:"exec"`
+	// workflow the command is a node of, retries of a node stay in it
+	WorkflowId   *string      `json:"workflowId"`
+	WorkflowNode string       `json:"workflowNode"`
+	DependsOn    Dependencies `json:"dependsOn"`
+	// template the command was rendered from
+	TemplateId *string `json:"templateId"`
+	// exempt from the retention policy
+	Pinned bool `json:"pinned"`
+	// when a PENDING retry attempt is released, nil for other commands
+	RetryAt *string `json:"retryAt"`
+}
+
+// initial terminal size of a tty command
+func (c *Command) TtySize() (uint16, uint16) {
+	rows, cols := uint16(DEFAULT_TTY_ROWS), uint16(DEFAULT_TTY_COLS)
+	if c.TtyRows != nil {
+		rows = uint16(*c.TtyRows)
+	}
+	if c.TtyCols != nil {
+		cols = uint16(*c.TtyCols)
+	}
+	return rows, cols
+}
+
+// environment variables set on top of the server's environment,
+// stored as a json object in the command table
+type CommandEnv map[string]string
+
+func (e CommandEnv) Value() (driver.Value, error) {
+	if e == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (e *CommandEnv) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*e = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("cannot scan %T into CommandEnv", src)
+	}
+	return json.Unmarshal(data, e)
+}
+
+// `KEY=VALUE` pairs in key order
+func (e CommandEnv) Environ() []string {
+	keys := slices.Sorted(maps.Keys(e))
+	environ := make([]string, 0, len(keys))
+	for _, key := range keys {
+		environ = append(environ, key+"="+e[key])
+	}
+	return environ
 }
 
 type Log struct {
@@ -42,27 +192,104 @@ type Log struct {
 }
 
 type DB interface {
-	NewCommand(command string) (*Command, error)
+	NewCommand(command *Command) (*Command, error)
 	GetCommand(id string) (*Command, error)
 	ListCommands(before string, n uint) ([]Command, error)
+	ListCommandsByStatus(statuses ...CommandStatus) ([]Command, error)
+	GetLineage(id string) ([]Command, error)
+	// delete the command with its logs and resource samples
 	DeleteCommand(id string) error
+	// insert the log or replace the content of an updated partial line
 	AddLog(log *Log) error
+	// queue the log to be inserted with the next batch, see LogWriter
+	QueueLog(log *Log) error
+	// commit every queued log, returns how many logs of the command were
+	// dropped since its last flush
+	FlushLogs(commandId string) int
+	LogStats() LogWriterStats
 	GetLogs(commandId string, before string, n uint) ([]Log, error)
 	UpdateStatus(id string, status CommandStatus) error
+	// switch a live command between RUNNING and PAUSED, fails with
+	// sql.ErrNoRows once the command finished
+	UpdateRunningStatus(id string, status CommandStatus) error
+	UpdateStarted(id string, startedAt string, pid int, pgid int) error
+	UpdateFinished(command *Command) error
+	Vacuum() (*VacuumResult, error)
+
+	SaveQueue(queue *Queue) error
+	GetQueue(name string) (*Queue, error)
+	ListQueues() ([]Queue, error)
+	DeleteQueue(name string) error
+	ListQueued(queue string, n uint) ([]Command, error)
+	ReorderQueue(queue string, ids []string) error
+	Dequeue(id string) error
+	CancelQueued(id string) error
+
+	NewSchedule(schedule *Schedule) (*Schedule, error)
+	GetSchedule(id string) (*Schedule, error)
+	ListSchedules() ([]Schedule, error)
+	UpdateSchedule(schedule *Schedule) error
+	UpdateScheduleRun(schedule *Schedule) error
+	DeleteSchedule(id string) error
+	AddResourceSample(sample *ResourceSample) error
+	// samples of a command in the order they were taken
+	GetResourceSamples(commandId string) ([]ResourceSample, error)
+
+	NewWorkflow(workflow *Workflow) (*Workflow, error)
+	// the workflow with the latest attempt of each of its nodes
+	GetWorkflow(id string) (*Workflow, error)
+	ListWorkflows(before string, n uint) ([]Workflow, error)
+	ListWorkflowsByStatus(statuses ...WorkflowStatus) ([]Workflow, error)
+	UpdateWorkflowStatus(workflow *Workflow) error
+	// move a PENDING node to IDLE, or QUEUED if it has a queue, returning
+	// the new status. fails with sql.ErrNoRows if it is not PENDING
+	ReleasePending(id string) (CommandStatus, error)
+	// mark a PENDING node as SKIPPED, fails with sql.ErrNoRows if it is not PENDING
+	SkipPending(id string) error
+
+	NewTemplate(template *Template) (*Template, error)
+	GetTemplate(id string) (*Template, error)
+	ListTemplates() ([]Template, error)
+	UpdateTemplate(template *Template) error
+	DeleteTemplate(id string) error
+
+	// fails with sql.ErrNoRows if the command does not exist
+	PinCommand(id string, pinned bool) error
+	GetRetentionPolicy() (*RetentionPolicy, error)
+	SaveRetentionPolicy(policy *RetentionPolicy) error
+	// prune the finished commands and logs `policy` does not keep at `now`,
+	// returns what was reclaimed and the ids of the deleted commands
+	ApplyRetention(policy *RetentionPolicy, now time.Time) (*RetentionReport, []string, error)
+
+	// matching commands and logs, newest first
+	Search(query *SearchQuery) ([]SearchResult, error)
 }
 
 type CockpitDB struct {
 	*sql.DB
-	Bus *EventBus
+	Bus  *EventBus
+	logs *LogWriter
 }
 
-func NewDB(dataSourceName string, bus *EventBus) (DB, error) {
-	dataSourceName += "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+// where the server keeps its database
+const DATA_SOURCE_NAME = "file:cockpit.db"
+
+// open the database without touching its schema
+func OpenDB(dataSourceName string) (*sql.DB, error) {
+	dataSourceName += "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
 	sqlDB, err := sql.Open("sqlite", dataSourceName)
 	if err != nil {
 		slog.Error("cannot open `cockpit.db` database file", "error", err)
 		return nil, err
 	}
+	return sqlDB, nil
+}
+
+func NewDB(dataSourceName string, bus *EventBus) (DB, error) {
+	sqlDB, err := OpenDB(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
 
 	db := CockpitDB{
 		DB:  sqlDB,
@@ -72,57 +299,106 @@ func NewDB(dataSourceName string, bus *EventBus) (DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	db.logs = NewLogWriter(sqlDB)
 	return &db, nil
 }
 
 const COMMAND_TABLE_NAME = "command"
 const TABLE_SCHEMA_QUERY = "SELECT sql FROM sqlite_schema WHERE name=?"
-const CREATE_COMMAND_TABLE_QUERY = `
-CREATE TABLE IF NOT EXISTS command (
-    id TEXT PRIMARY KEY,
-    created_at TEXT NOT NULL,
-    command TEXT NOT NULL,
-    status TEXT NOT NULL
-);
-`
-const CREATE_LOG_TABLE_QUERY = `
-CREATE TABLE IF NOT EXISTS log (
-    id TEXT PRIMARY KEY,
-    command_id TEXT NOT NULL,
-    created_at TEXT NOT NULL,
-    content TEXT NOT NULL,
-    fd INTEGER NOT NULL,
-    FOREIGN KEY (command_id) REFERENCES command (id)
-);
-`
+const TABLE_COLUMNS_QUERY = "SELECT name FROM pragma_table_info(?)"
 const INSERT_COMMAND_QUERY = `
-INSERT INTO command (id, created_at, command, status)
-VALUES (?, ?, ?, ?);
+INSERT INTO command (
+    id, created_at, command, status, timeout_ms, deadline, cwd, env,
+    rerun_of, retry, attempt, tty, tty_rows, tty_cols, stdin, limits, exec,
+    workflow_id, workflow_node, depends_on, template_id, queue, queue_position,
+    retry_at
+)
+VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8,
+    $9, $10, $11, $12, $13, $14, $15, $16, $17,
+    $18, $19, $20, $21, $22, CASE WHEN $22 = '' THEN NULL ELSE (
+        SELECT COALESCE(MAX(queue_position), 0) + 1 FROM command WHERE queue = $22
+    ) END,
+    $23
+)
+RETURNING queue_position;
+`
+const COMMAND_COLUMNS = `
+id, created_at, command, status,
+exit_code, term_signal, started_at, finished_at, duration_ms,
+timeout_ms, deadline, cwd, env, pid, pgid, queue, queue_position,
+rerun_of, retry, attempt, tty, tty_rows, tty_cols, stdin,
+peak_rss, limits, term_reason, exec,
+workflow_id, workflow_node, depends_on, template_id, pinned, retry_at
 `
 const SELECT_COMMAND_QUERY = `
-SELECT id, created_at, command, status
+SELECT ` + COMMAND_COLUMNS + `
 FROM command
 WHERE id = $1;
 `
 const LIST_COMMAND_QUERY = `
-SELECT id, created_at, command, status 
+SELECT ` + COMMAND_COLUMNS + `
 FROM command
 WHERE id < $1
 ORDER BY id DESC
 LIMIT $2;
 `
+const LIST_COMMAND_BY_STATUS_QUERY = `
+SELECT ` + COMMAND_COLUMNS + `
+FROM command
+WHERE status IN (SELECT value FROM json_each($1))
+ORDER BY id;
+`
+// every command sharing the rerun tree of $1, from its root downwards
+const SELECT_LINEAGE_QUERY = `
+WITH RECURSIVE ancestor(id, rerun_of) AS (
+    SELECT id, rerun_of FROM command WHERE id = $1
+    UNION ALL
+    SELECT c.id, c.rerun_of FROM command c JOIN ancestor a ON c.id = a.rerun_of
+),
+root(id) AS (
+    SELECT a.id FROM ancestor a
+    WHERE NOT EXISTS (SELECT 1 FROM command c WHERE c.id = a.rerun_of)
+),
+tree(id) AS (
+    SELECT id FROM root
+    UNION ALL
+    SELECT c.id FROM command c JOIN tree t ON c.rerun_of = t.id
+)
+SELECT ` + COMMAND_COLUMNS + `
+FROM command
+WHERE id IN (SELECT id FROM tree)
+ORDER BY id;
+`
 const UPDATE_STATUS_QUERY = `
 UPDATE command
 SET status = ?
 WHERE id = ?;
 `
+const UPDATE_RUNNING_STATUS_QUERY = `
+UPDATE command
+SET status = ?
+WHERE id = ? AND status IN ('RUNNING', 'PAUSED');
+`
+const UPDATE_STARTED_QUERY = `
+UPDATE command
+SET started_at = ?, pid = ?, pgid = ?
+WHERE id = ?;
+`
+const UPDATE_FINISHED_QUERY = `
+UPDATE command
+SET status = ?, exit_code = ?, term_signal = ?, finished_at = ?, duration_ms = ?,
+    peak_rss = COALESCE(?, peak_rss), term_reason = ?
+WHERE id = ?;
+`
 const DELETE_COMMAND_QUERY = `
 DELETE FROM command
 WHERE id = $1;
 `
 const INSERT_LOG_QUERY = `
 INSERT INTO log (id, command_id, created_at, content, fd)
-VALUES (?, ?, ?, ?, ?);
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET content = excluded.content;
 `
 const SELECT_LOG_QUERY = `
 SELECT id, command_id, created_at, content, fd
@@ -141,36 +417,119 @@ func (db *CockpitDB) Init() error {
 		return err
 	}
 
-	// create tables if not exist
-	if _, err := db.Exec(CREATE_COMMAND_TABLE_QUERY); err != nil {
-		slog.Error("unable to create command table", "error", err)
+	if err := Migrate(db.DB, MIGRATIONS); err != nil {
+		slog.Error("unable to migrate database", "error", err)
 		return err
 	}
+	return nil
+}
+
+// Database file size before and after a VACUUM
+type VacuumResult struct {
+	SizeBefore int64 `json:"sizeBefore"`
+	SizeAfter  int64 `json:"sizeAfter"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+const DATABASE_SIZE_QUERY = `
+SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();
+`
+
+// rebuild the database file to return the space of deleted rows,
+// blocks every other write while it runs
+func (db *CockpitDB) Vacuum() (*VacuumResult, error) {
+	result := &VacuumResult{}
+	if err := db.QueryRow(DATABASE_SIZE_QUERY).Scan(&result.SizeBefore); err != nil {
+		return nil, err
+	}
 
-	if _, err := db.Exec(CREATE_LOG_TABLE_QUERY); err != nil {
-		slog.Error("unable to create log table", "error", err)
-		return err
+	started := time.Now()
+	if _, err := db.Exec("VACUUM;"); err != nil {
+		slog.Error("failed to vacuum", "error", err)
+		return nil, err
 	}
+	// the search indexes refer to rows by rowid, which VACUUM may change
+	if _, err := db.Exec(REBUILD_SEARCH_QUERY); err != nil {
+		slog.Error("failed to rebuild search indexes", "error", err)
+		return nil, err
+	}
+	// the rebuilt pages pass through the wal, truncate it afterwards
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		slog.Error("failed to checkpoint wal", "error", err)
+	}
+	result.DurationMs = time.Since(started).Milliseconds()
 
-	return nil
+	if err := db.QueryRow(DATABASE_SIZE_QUERY).Scan(&result.SizeAfter); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (db *CockpitDB) NewCommand(command string) (*Command, error) {
-	id := IdGen()
-	createdAt := FormatNow()
-	status := COMMAND_IDLE
-	_, err := db.Exec(INSERT_COMMAND_QUERY, id, createdAt, command, status)
-	if err != nil {
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCommand(row rowScanner, c *Command) error {
+	return row.Scan(
+		&c.Id, &c.CreatedAt, &c.Command, &c.Status,
+		&c.ExitCode, &c.TermSignal, &c.StartedAt, &c.FinishedAt, &c.DurationMs,
+		&c.TimeoutMs, &c.Deadline, &c.Cwd, &c.Env, &c.Pid, &c.Pgid,
+		&c.Queue, &c.QueuePosition, &c.RerunOf, &c.Retry, &c.Attempt,
+		&c.Tty, &c.TtyRows, &c.TtyCols, &c.Stdin, &c.PeakRss,
+		&c.Limits, &c.TermReason, &c.Exec,
+		&c.WorkflowId, &c.WorkflowNode, &c.DependsOn, &c.TemplateId,
+		&c.Pinned, &c.RetryAt,
+	)
+}
+
+// insert a new command, `command` carries the user supplied fields.
+// commands with a queue start out QUEUED at the end of it, others IDLE.
+// commands passed in as PENDING stay PENDING until they are released
+func (db *CockpitDB) NewCommand(command *Command) (*Command, error) {
+	commandInfo := *command
+	commandInfo.Id = IdGen()
+	commandInfo.CreatedAt = FormatNow()
+	// PENDING workflow nodes and retry attempts wait to be released
+	if commandInfo.Status != COMMAND_PENDING {
+		commandInfo.Status = COMMAND_IDLE
+		if len(commandInfo.Queue) > 0 {
+			commandInfo.Status = COMMAND_QUEUED
+		}
+	}
+	if commandInfo.Attempt == 0 {
+		commandInfo.Attempt = 1
+	}
+	row := db.QueryRow(
+		INSERT_COMMAND_QUERY,
+		commandInfo.Id,
+		commandInfo.CreatedAt,
+		commandInfo.Command,
+		commandInfo.Status,
+		commandInfo.TimeoutMs,
+		commandInfo.Deadline,
+		commandInfo.Cwd,
+		commandInfo.Env,
+		commandInfo.RerunOf,
+		commandInfo.Retry,
+		commandInfo.Attempt,
+		commandInfo.Tty,
+		commandInfo.TtyRows,
+		commandInfo.TtyCols,
+		commandInfo.Stdin,
+		commandInfo.Limits,
+		commandInfo.Exec,
+		commandInfo.WorkflowId,
+		commandInfo.WorkflowNode,
+		commandInfo.DependsOn,
+		commandInfo.TemplateId,
+		commandInfo.Queue,
+		commandInfo.RetryAt,
+	)
+	if err := row.Scan(&commandInfo.QueuePosition); err != nil {
 		slog.Error("failed to insert new command", "error", err)
 		return nil, err
 	}
 
-	commandInfo := Command{
-		Id:        id,
-		CreatedAt: createdAt,
-		Command:   command,
-		Status:    status,
-	}
 	return &commandInfo, nil
 }
 
@@ -183,11 +542,49 @@ func (db *CockpitDB) UpdateStatus(id string, status CommandStatus) error {
 	return nil
 }
 
+func (db *CockpitDB) UpdateRunningStatus(id string, status CommandStatus) error {
+	result, err := db.Exec(UPDATE_RUNNING_STATUS_QUERY, status, id)
+	if err != nil {
+		slog.Error("failed to update running status", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+func (db *CockpitDB) UpdateStarted(id string, startedAt string, pid int, pgid int) error {
+	_, err := db.Exec(UPDATE_STARTED_QUERY, startedAt, pid, pgid, id)
+	if err != nil {
+		slog.Error("failed to update started_at", "error", err)
+		return err
+	}
+	return nil
+}
+
+// write the terminal status and exit information of `command`
+func (db *CockpitDB) UpdateFinished(command *Command) error {
+	_, err := db.Exec(
+		UPDATE_FINISHED_QUERY,
+		command.Status,
+		command.ExitCode,
+		command.TermSignal,
+		command.FinishedAt,
+		command.DurationMs,
+		command.PeakRss,
+		command.TermReason,
+		command.Id,
+	)
+	if err != nil {
+		slog.Error("failed to update finished command", "error", err)
+		return err
+	}
+	return nil
+}
+
 func (db *CockpitDB) GetCommand(id string) (*Command, error) {
 	var c Command
 
 	row := db.QueryRow(SELECT_COMMAND_QUERY, id)
-	if err := row.Scan(&c.Id, &c.CreatedAt, &c.Command, &c.Status); err != nil {
+	if err := scanCommand(row, &c); err != nil {
 		return nil, err
 	}
 	return &c, nil
@@ -207,7 +604,7 @@ func (db *CockpitDB) ListCommands(before string, n uint) ([]Command, error) {
 	commands := []Command{}
 	for rows.Next() {
 		var c Command
-		err := rows.Scan(&c.Id, &c.CreatedAt, &c.Command, &c.Status)
+		err := scanCommand(rows, &c)
 		if err != nil {
 			slog.Error("ListCommands", "error", err)
 			continue
@@ -222,6 +619,63 @@ func (db *CockpitDB) ListCommands(before string, n uint) ([]Command, error) {
 	return commands, nil
 }
 
+// list commands in any of `statuses`, oldest first
+func (db *CockpitDB) ListCommandsByStatus(statuses ...CommandStatus) ([]Command, error) {
+	statusList, err := json.Marshal(statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(LIST_COMMAND_BY_STATUS_QUERY, string(statusList))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []Command{}
+	for rows.Next() {
+		var c Command
+		err := scanCommand(rows, &c)
+		if err != nil {
+			slog.Error("ListCommandsByStatus", "error", err)
+			continue
+		}
+
+		commands = append(commands, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return commands, err
+	}
+	return commands, nil
+}
+
+// the original command and all of its reruns, oldest first
+func (db *CockpitDB) GetLineage(id string) ([]Command, error) {
+	rows, err := db.Query(SELECT_LINEAGE_QUERY, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []Command{}
+	for rows.Next() {
+		var c Command
+		err := scanCommand(rows, &c)
+		if err != nil {
+			slog.Error("GetLineage", "error", err)
+			continue
+		}
+
+		commands = append(commands, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return commands, err
+	}
+	return commands, nil
+}
+
 func (db *CockpitDB) DeleteCommand(id string) error {
 	_, err := db.Exec(DELETE_COMMAND_QUERY, id)
 	if err != nil {
@@ -247,6 +701,18 @@ func (db *CockpitDB) AddLog(log *Log) error {
 	return nil
 }
 
+func (db *CockpitDB) QueueLog(log *Log) error {
+	return db.logs.Write(log)
+}
+
+func (db *CockpitDB) FlushLogs(commandId string) int {
+	return db.logs.Flush(commandId)
+}
+
+func (db *CockpitDB) LogStats() LogWriterStats {
+	return db.logs.Stats()
+}
+
 func (db *CockpitDB) GetLogs(commandId string, before string, n uint) ([]Log, error) {
 	if len(before) == 0 {
 		before = MAX_ID
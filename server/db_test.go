@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -27,10 +29,40 @@ func TestDB(t *testing.T) {
 	t.Run("db log", func(t *testing.T) {
 		testDBLog(t, db, info)
 	})
+
+	t.Run("db finished", func(t *testing.T) {
+		testDBFinished(t, db, info)
+	})
+
+	t.Run("db queue", func(t *testing.T) {
+		testDBQueue(t, db)
+	})
+
+	t.Run("db lineage", func(t *testing.T) {
+		testDBLineage(t, db)
+	})
+
+	t.Run("db cascade", func(t *testing.T) {
+		testDBCascade(t, db)
+	})
+
+	t.Run("db vacuum", func(t *testing.T) {
+		result, err := db.Vacuum()
+		if err != nil {
+			t.Fatalf("Vacuum error: %s\n", err)
+		}
+		if result.SizeBefore <= 0 || result.SizeAfter <= 0 {
+			t.Errorf("unexpected sizes %v\n", result)
+		}
+	})
 }
 
 func testDBCommand(t *testing.T, db DB) *Command {
-	info, err := db.NewCommand("ls -alh")
+	info, err := db.NewCommand(&Command{
+		Command: "ls -alh",
+		Cwd:     "/tmp",
+		Env:     CommandEnv{"FOO": "bar"},
+	})
 	if err != nil {
 		t.Fatalf("NewCommand error: %s\n", err)
 	}
@@ -53,6 +85,9 @@ func testDBCommand(t *testing.T, db DB) *Command {
 	if infos[0].Id != info.Id {
 		t.Errorf("commands differ!\n")
 	}
+	if infos[0].Cwd != "/tmp" || infos[0].Env["FOO"] != "bar" {
+		t.Errorf("cwd or env differ: %s %v\n", infos[0].Cwd, infos[0].Env)
+	}
 	return info
 }
 
@@ -87,3 +122,214 @@ func testDBLog(t *testing.T, db DB, info *Command) {
 		t.Errorf("logs differ\n")
 	}
 }
+
+func testDBFinished(t *testing.T, db DB, info *Command) {
+	exitCode := 1
+	finishedAt := FormatNow()
+	durationMs := int64(1500)
+	result := &Command{
+		Id:         info.Id,
+		Status:     COMMAND_ERROR,
+		ExitCode:   &exitCode,
+		FinishedAt: &finishedAt,
+		DurationMs: &durationMs,
+	}
+	if err := db.UpdateFinished(result); err != nil {
+		t.Fatalf("UpdateFinished error: %s\n", err)
+	}
+
+	command, err := db.GetCommand(info.Id)
+	if err != nil {
+		t.Fatalf("GetCommand error: %s\n", err)
+	}
+
+	if command.Status != COMMAND_ERROR {
+		t.Errorf("status differ: %s\n", command.Status)
+	}
+	if command.ExitCode == nil || *command.ExitCode != exitCode {
+		t.Errorf("exit code differ: %v\n", command.ExitCode)
+	}
+	if command.TermSignal != nil {
+		t.Errorf("unexpected term signal: %v\n", *command.TermSignal)
+	}
+	if command.DurationMs == nil || *command.DurationMs != durationMs {
+		t.Errorf("duration differ: %v\n", command.DurationMs)
+	}
+}
+
+func testDBQueue(t *testing.T, db DB) {
+	if err := db.SaveQueue(&Queue{Name: "transcode", MaxConcurrency: 1}); err != nil {
+		t.Fatalf("SaveQueue error: %s\n", err)
+	}
+
+	ids := []string{}
+	for range 3 {
+		command, err := db.NewCommand(&Command{Command: "true", Queue: "transcode"})
+		if err != nil {
+			t.Fatalf("NewCommand error: %s\n", err)
+		}
+		if command.Status != COMMAND_QUEUED {
+			t.Errorf("expected QUEUED status, got %s\n", command.Status)
+		}
+		ids = append(ids, command.Id)
+	}
+
+	if err := db.ReorderQueue("transcode", []string{ids[2]}); err != nil {
+		t.Fatalf("ReorderQueue error: %s\n", err)
+	}
+	if err := db.CancelQueued(ids[1]); err != nil {
+		t.Fatalf("CancelQueued error: %s\n", err)
+	}
+	if err := db.Dequeue(ids[1]); err != ErrNotQueued {
+		t.Errorf("expected ErrNotQueued for canceled command, got %v\n", err)
+	}
+
+	queued, err := db.ListQueued("transcode", 10)
+	if err != nil {
+		t.Fatalf("ListQueued error: %s\n", err)
+	}
+	if len(queued) != 2 || queued[0].Id != ids[2] || queued[1].Id != ids[0] {
+		t.Errorf("unexpected queue order: %v\n", queued)
+	}
+
+	queue, err := db.GetQueue("transcode")
+	if err != nil {
+		t.Fatalf("GetQueue error: %s\n", err)
+	}
+	if queue.Queued != 2 || queue.Running != 0 {
+		t.Errorf("unexpected queue depth: %+v\n", queue)
+	}
+
+	if err := db.DeleteQueue("transcode"); err != ErrQueueNotEmpty {
+		t.Errorf("expected ErrQueueNotEmpty, got %v\n", err)
+	}
+}
+
+func testDBLineage(t *testing.T, db DB) {
+	original, err := db.NewCommand(&Command{Command: "axel http://example.com/a.mp4"})
+	if err != nil {
+		t.Fatalf("NewCommand error: %s\n", err)
+	}
+	ids := []string{original.Id}
+
+	parent := original
+	for range 2 {
+		rerun, err := db.NewCommand(RerunOf(parent))
+		if err != nil {
+			t.Fatalf("NewCommand rerun error: %s\n", err)
+		}
+		ids = append(ids, rerun.Id)
+		parent = rerun
+	}
+
+	for _, id := range ids {
+		lineage, err := db.GetLineage(id)
+		if err != nil {
+			t.Fatalf("GetLineage error: %s\n", err)
+		}
+		if len(lineage) != len(ids) {
+			t.Fatalf("expected %d commands in lineage, got %d\n", len(ids), len(lineage))
+		}
+		for i := range ids {
+			if lineage[i].Id != ids[i] {
+				t.Errorf("lineage[%d] differ: %s != %s\n", i, lineage[i].Id, ids[i])
+			}
+		}
+	}
+}
+
+func testDBCascade(t *testing.T, db DB) {
+	info, err := db.NewCommand(&Command{Command: "echo hi"})
+	if err != nil {
+		t.Fatalf("NewCommand error: %s\n", err)
+	}
+	err = db.AddLog(&Log{Id: IdGen(), CommandId: info.Id, CreatedAt: FormatNow(), Content: "hi", FD: LOG_STDOUT})
+	if err != nil {
+		t.Fatalf("AddLog error: %s\n", err)
+	}
+	err = db.AddResourceSample(&ResourceSample{Id: IdGen(), CommandId: info.Id, CreatedAt: FormatNow()})
+	if err != nil {
+		t.Fatalf("AddResourceSample error: %s\n", err)
+	}
+
+	if err := db.DeleteCommand(info.Id); err != nil {
+		t.Fatalf("DeleteCommand error: %s\n", err)
+	}
+
+	logs, err := db.GetLogs(info.Id, "", 10)
+	if err != nil {
+		t.Fatalf("GetLogs error: %s\n", err)
+	}
+	if len(logs) != 0 {
+		t.Errorf("%d logs left after delete\n", len(logs))
+	}
+	samples, err := db.GetResourceSamples(info.Id)
+	if err != nil {
+		t.Fatalf("GetResourceSamples error: %s\n", err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("%d resource samples left after delete\n", len(samples))
+	}
+
+	err = db.AddLog(&Log{Id: IdGen(), CommandId: info.Id, CreatedAt: FormatNow(), Content: "late", FD: LOG_STDOUT})
+	if err == nil {
+		t.Errorf("log of a deleted command was inserted\n")
+	}
+}
+
+// a database from before the cascade keeps its logs and loses the orphans
+func TestDBCascadeMigration(t *testing.T) {
+	dsn := "file:" + t.TempDir() + "/cascade.db"
+	old, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open error: %s\n", err)
+	}
+	_, err = old.Exec(`
+CREATE TABLE command (id TEXT PRIMARY KEY, created_at TEXT NOT NULL, command TEXT NOT NULL, status TEXT NOT NULL);
+CREATE TABLE log (
+    id TEXT PRIMARY KEY,
+    command_id TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    content TEXT NOT NULL,
+    fd INTEGER NOT NULL,
+    FOREIGN KEY (command_id) REFERENCES command (id)
+);
+INSERT INTO command VALUES ('kept', '2024-01-01T00:00:00Z', 'echo', 'FINISHED');
+INSERT INTO log VALUES ('01HX0000000000000000000000', 'kept', '2024-01-01T00:00:00Z', 'kept', 1);
+INSERT INTO log VALUES ('01HX0000000000000000000001', 'gone', '2024-01-01T00:00:00Z', 'orphan', 1);
+`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("create old schema error: %s\n", err)
+	}
+
+	db, err := NewDB(dsn, NewEventBus())
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	cockpitDB := db.(*CockpitDB)
+	defer cockpitDB.Close()
+
+	var schema string
+	if err := cockpitDB.QueryRow(TABLE_SCHEMA_QUERY, "log").Scan(&schema); err != nil {
+		t.Fatalf("log schema error: %s\n", err)
+	}
+	if !strings.Contains(schema, "ON DELETE CASCADE") {
+		t.Errorf("log table has no cascade: %s\n", schema)
+	}
+
+	logs, err := db.GetLogs("kept", "", 10)
+	if err != nil {
+		t.Fatalf("GetLogs error: %s\n", err)
+	}
+	if len(logs) != 1 || logs[0].Content != "kept" {
+		t.Errorf("unexpected logs %v\n", logs)
+	}
+	var orphans int
+	if err := cockpitDB.QueryRow("SELECT COUNT(*) FROM log WHERE command_id = 'gone'").Scan(&orphans); err != nil {
+		t.Fatalf("count orphans error: %s\n", err)
+	}
+	if orphans != 0 {
+		t.Errorf("%d orphan logs left\n", orphans)
+	}
+}
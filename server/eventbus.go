@@ -12,6 +12,7 @@ type SubCallback[T any] func(T)
 type Topic[T any] struct {
 	channels []chan T
 	mu   sync.Mutex
+	closed bool
 }
 
 func NewTopic[T any]() *Topic[T] {
@@ -23,15 +24,26 @@ func NewTopic[T any]() *Topic[T] {
 	return &topic
 }
 
+// closing a closed topic does nothing
 func (t *Topic[T]) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
 	for _, c := range t.channels {
 		close(c)
 	}
 }
 
+// messages published after Close are dropped
 func (t *Topic[T]) Pub(v T) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
 	for _, c := range t.channels {
 		c <- v
 	}
@@ -49,9 +61,30 @@ func (t *Topic[T]) Sub(cb SubCallback[T]) UnSub {
 
 func (t *Topic[T]) SubChan() (chan T, UnSub) {
 	c := make(chan T)
-	t.channels = append(t.channels , c)
+	t.mu.Lock()
+	t.channels = append(t.channels, c)
+	t.mu.Unlock()
 
 	unsub := func() {
+		// a Pub blocked on sending to `c` holds the lock,
+		// drain `c` until it lets go of it
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case _, ok := <-c:
+					if !ok {
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		close(stop)
 		t.channels = slices.DeleteFunc(t.channels, func(cc chan T) bool {
 			return cc == c
 		})
@@ -60,6 +93,7 @@ func (t *Topic[T]) SubChan() (chan T, UnSub) {
 }
 
 type EventBus struct {
+	mu     sync.RWMutex
 	topics map[string]any
 }
 
@@ -68,6 +102,8 @@ func NewEventBus() *EventBus {
 }
 
 func CreateTopic[T any](bus *EventBus, topicName string) (*Topic[T], error) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
 	_, found := bus.topics[topicName]
 	if found {
 		return nil, fmt.Errorf("topic %s already exists", topicName)
@@ -82,7 +118,9 @@ func CreateTopic[T any](bus *EventBus, topicName string) (*Topic[T], error) {
 // if theres no topic named `topicName` then creates a new topic
 func GetTopic[T any](bus *EventBus, topicName string) (*Topic[T], error) {
 	var topic *Topic[T]
+	bus.mu.RLock()
 	topicAny, found := bus.topics[topicName]
+	bus.mu.RUnlock()
 	if found {
 		if typedTopic, ok := topicAny.(*Topic[T]); ok {
 			topic = typedTopic
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type ExecMode string
+
+const (
+	// `Command` is run by a shell
+	EXEC_SHELL ExecMode = "shell"
+	// `Argv` is executed as is without a shell
+	EXEC_ARGV ExecMode = "argv"
+	// `Command` is written to a temporary file run by `Interpreter`
+	EXEC_SCRIPT ExecMode = "script"
+)
+
+// shell of commands without an exec spec
+const DEFAULT_SHELL = "bash"
+
+// How a command is executed, commands without a spec run in DEFAULT_SHELL
+type ExecSpec struct {
+	Mode ExecMode `json:"mode"`
+	// shell path like `sh` or `/bin/zsh`, defaults to DEFAULT_SHELL
+	Shell string `json:"shell"`
+	// program and its arguments
+	Argv []string `json:"argv"`
+	// interpreter with its arguments, the script path is appended.
+	// defaults to DEFAULT_SHELL
+	Interpreter []string `json:"interpreter"`
+}
+
+func (e *ExecSpec) Value() (driver.Value, error) {
+	if e == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (e *ExecSpec) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	case []byte:
+		return json.Unmarshal(v, e)
+	default:
+		return fmt.Errorf("cannot scan %T into ExecSpec", src)
+	}
+}
+
+// check the spec and that its programs can be found
+func (e *ExecSpec) Validate() error {
+	var program string
+	switch e.Mode {
+	case EXEC_SHELL:
+		if len(e.Argv) > 0 || len(e.Interpreter) > 0 {
+			return fmt.Errorf("shell mode takes no argv or interpreter")
+		}
+		program = e.Shell
+	case EXEC_ARGV:
+		if len(e.Argv) == 0 || len(e.Argv[0]) == 0 {
+			return fmt.Errorf("argv mode needs a program")
+		}
+		if len(e.Shell) > 0 || len(e.Interpreter) > 0 {
+			return fmt.Errorf("argv mode takes no shell or interpreter")
+		}
+		program = e.Argv[0]
+	case EXEC_SCRIPT:
+		if len(e.Shell) > 0 || len(e.Argv) > 0 {
+			return fmt.Errorf("script mode takes no shell or argv")
+		}
+		if len(e.Interpreter) > 0 {
+			program = e.Interpreter[0]
+		}
+	default:
+		return fmt.Errorf("invalid exec mode %q", e.Mode)
+	}
+
+	if len(program) > 0 {
+		if _, err := exec.LookPath(program); err != nil {
+			return fmt.Errorf("cannot find %s", program)
+		}
+	}
+	return nil
+}
+
+// Program and arguments running `command`. Scripts are written to a
+// temporary file which `cleanup` removes once the command finished.
+func CommandArgs(command *Command) ([]string, func(), error) {
+	noop := func() {}
+	spec := command.Exec
+	if spec == nil {
+		return []string{DEFAULT_SHELL, "-c", command.Command}, noop, nil
+	}
+
+	switch spec.Mode {
+	case EXEC_ARGV:
+		return spec.Argv, noop, nil
+	case EXEC_SCRIPT:
+		path, err := writeScript(command)
+		if err != nil {
+			return nil, noop, err
+		}
+		interpreter := spec.Interpreter
+		if len(interpreter) == 0 {
+			interpreter = []string{DEFAULT_SHELL}
+		}
+		args := append(append([]string{}, interpreter...), path)
+		return args, func() { os.Remove(path) }, nil
+	default:
+		shell := spec.Shell
+		if len(shell) == 0 {
+			shell = DEFAULT_SHELL
+		}
+		return []string{shell, "-c", command.Command}, noop, nil
+	}
+}
+
+func writeScript(command *Command) (string, error) {
+	file, err := os.CreateTemp("", "cockpit-"+command.Id+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(command.Command); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Chmod(0700); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// quote `s` as a single shell word
+func ShellQuote(s string) string {
+	if len(s) > 0 && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// argv as a shell command line, how argv commands are displayed
+func QuoteArgv(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = ShellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -5,6 +5,8 @@ go 1.25.1
 require (
 	github.com/labstack/echo/v4 v4.13.4
 	github.com/oklog/ulid/v2 v2.1.1
+	golang.org/x/net v0.40.0
+	golang.org/x/sys v0.34.0
 	modernc.org/sqlite v1.39.0
 )
 
@@ -20,8 +22,6 @@ require (
 	github.com/valyala/fasttemplate v1.2.2 // indirect
 	golang.org/x/crypto v0.39.0 // indirect
 	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
-	golang.org/x/net v0.40.0 // indirect
-	golang.org/x/sys v0.34.0 // indirect
 	golang.org/x/text v0.28.0 // indirect
 	golang.org/x/time v0.11.0 // indirect
 	modernc.org/libc v1.66.3 // indirect
@@ -2,16 +2,225 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 type NewCommand struct {
+	// shell command line or script body, ignored for argv commands
 	Command string `json:"command"`
+	// how the command is executed, runs `Command` in bash when omitted
+	Exec *ExecSpec `json:"exec"`
+	// duration string like `90m`, the command is stopped once it runs longer
+	Timeout string `json:"timeout"`
+	// RFC3339 timestamp, the command is stopped once it is reached
+	Deadline string `json:"deadline"`
+	// working directory, defaults to the server's working directory
+	Cwd string `json:"cwd"`
+	// variables added to the server's environment
+	Env map[string]string `json:"env"`
+	// queue to wait in, the command runs immediately when empty
+	Queue string `json:"queue"`
+	// start the command again when it fails
+	Retry *NewRetry `json:"retry"`
+	// run under a pseudo terminal, stdout and stderr are merged
+	Tty  bool `json:"tty"`
+	Rows int  `json:"rows"`
+	Cols int  `json:"cols"`
+	// keep stdin open to send input later, implied by tty
+	Stdin bool `json:"stdin"`
+	// resource limits, none when omitted
+	Limits *NewLimits `json:"limits"`
+}
+
+type NewLimits struct {
+	// size like `512M` or `2G`
+	Memory       string  `json:"memory"`
+	Cpus         float64 `json:"cpus"`
+	MaxProcesses int64   `json:"maxProcesses"`
+	MaxOpenFiles int64   `json:"maxOpenFiles"`
+	Nice         *int    `json:"nice"`
+	// `realtime`, `best-effort` or `idle`
+	IoClass    string `json:"ioClass"`
+	IoPriority *int   `json:"ioPriority"`
+}
+
+func (n *NewLimits) ToLimits() (*Limits, error) {
+	limits := &Limits{
+		Cpus:         n.Cpus,
+		MaxProcesses: n.MaxProcesses,
+		MaxOpenFiles: n.MaxOpenFiles,
+		Nice:         n.Nice,
+		IoClass:      IoClass(n.IoClass),
+		IoPriority:   n.IoPriority,
+	}
+	if len(n.Memory) > 0 {
+		memory, err := ParseByteSize(n.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory limit %s", n.Memory)
+		}
+		limits.MemoryBytes = memory
+	}
+
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+type NewRetry struct {
+	// total number of attempts including the first one
+	MaxAttempts int `json:"maxAttempts"`
+	// `fixed` or `exponential`, defaults to fixed
+	Backoff string `json:"backoff"`
+	// duration strings like `30s`
+	Delay    string `json:"delay"`
+	MaxDelay string `json:"maxDelay"`
+	// retry on non-zero exit codes, defaults to true
+	OnFailure *bool `json:"onFailure"`
+	// only retry these exit codes
+	ExitCodes []int `json:"exitCodes"`
+	OnTimeout bool  `json:"onTimeout"`
+}
+
+func (n *NewRetry) ToPolicy() (*RetryPolicy, error) {
+	if n.MaxAttempts < 1 || n.MaxAttempts > MAX_RETRY_ATTEMPTS {
+		return nil, fmt.Errorf("retry maxAttempts must be between 1 and %d", MAX_RETRY_ATTEMPTS)
+	}
+
+	policy := &RetryPolicy{
+		MaxAttempts: n.MaxAttempts,
+		Backoff:     RetryBackoff(n.Backoff),
+		OnFailure:   n.OnFailure == nil || *n.OnFailure,
+		ExitCodes:   n.ExitCodes,
+		OnTimeout:   n.OnTimeout,
+	}
+	switch policy.Backoff {
+	case "":
+		policy.Backoff = BACKOFF_FIXED
+	case BACKOFF_FIXED, BACKOFF_EXPONENTIAL:
+	default:
+		return nil, fmt.Errorf("invalid retry backoff %s", n.Backoff)
+	}
+
+	if len(n.Delay) > 0 {
+		delay, err := time.ParseDuration(n.Delay)
+		if err != nil || delay < 0 {
+			return nil, fmt.Errorf("invalid retry delay %s", n.Delay)
+		}
+		policy.DelayMs = delay.Milliseconds()
+	}
+	if len(n.MaxDelay) > 0 {
+		maxDelay, err := time.ParseDuration(n.MaxDelay)
+		if err != nil || maxDelay < 0 {
+			return nil, fmt.Errorf("invalid retry maxDelay %s", n.MaxDelay)
+		}
+		policy.MaxDelayMs = maxDelay.Milliseconds()
+	}
+
+	return policy, nil
+}
+
+// validate the request and convert it to a command to be inserted
+func (n *NewCommand) ToCommand() (*Command, error) {
+	command := &Command{
+		Command: n.Command,
+		Cwd:     n.Cwd,
+		Env:     n.Env,
+		Queue:   n.Queue,
+		Stdin:   n.Stdin || n.Tty,
+	}
+
+	if len(n.Cwd) > 0 {
+		if !filepath.IsAbs(n.Cwd) {
+			return nil, fmt.Errorf("cwd must be an absolute path")
+		}
+		info, err := os.Stat(n.Cwd)
+		if err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("cwd %s is not a directory", n.Cwd)
+		}
+	}
+
+	if n.Tty {
+		command.Tty = true
+		if n.Rows != 0 {
+			if err := ValidateTtySize(n.Rows, n.Cols); err != nil {
+				return nil, err
+			}
+			command.TtyRows = &n.Rows
+			command.TtyCols = &n.Cols
+		}
+	} else if n.Rows != 0 || n.Cols != 0 {
+		return nil, fmt.Errorf("rows and cols require tty")
+	}
+
+	if n.Retry != nil {
+		policy, err := n.Retry.ToPolicy()
+		if err != nil {
+			return nil, err
+		}
+		command.Retry = policy
+	}
+
+	if n.Exec != nil {
+		if err := n.Exec.Validate(); err != nil {
+			return nil, err
+		}
+		command.Exec = n.Exec
+		if n.Exec.Mode == EXEC_ARGV {
+			command.Command = QuoteArgv(n.Exec.Argv)
+		}
+	}
+
+	if n.Limits != nil {
+		limits, err := n.Limits.ToLimits()
+		if err != nil {
+			return nil, err
+		}
+		command.Limits = limits
+	}
+
+	for key, value := range n.Env {
+		if len(key) == 0 || strings.ContainsAny(key, "=\x00") || strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("invalid env variable %q", key)
+		}
+	}
+
+	if len(n.Timeout) > 0 {
+		timeout, err := time.ParseDuration(n.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be positive")
+		}
+		timeoutMs := timeout.Milliseconds()
+		command.TimeoutMs = &timeoutMs
+	}
+
+	if len(n.Deadline) > 0 {
+		deadline, err := time.Parse(time.RFC3339Nano, n.Deadline)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadline: %w", err)
+		}
+		if deadline.Before(time.Now()) {
+			return nil, fmt.Errorf("deadline is in the past")
+		}
+		formatted := deadline.UTC().Format(time.RFC3339Nano)
+		command.Deadline = &formatted
+	}
+
+	return command, nil
 }
 
 func NewCommandHandler(c echo.Context) error {
@@ -22,34 +231,92 @@ func NewCommandHandler(c echo.Context) error {
 		return cc.String(http.StatusBadRequest, "invalid json format")
 	}
 
-	command, err := cc.DB.NewCommand(newCommand.Command)
+	command, err := newCommand.ToCommand()
 	if err != nil {
-		slog.Error("NewCommandHandler cc.DB.NewCommand", "error", err)
-		return cc.String(http.StatusInternalServerError, "db fail")
+		return cc.String(http.StatusBadRequest, err.Error())
 	}
 
-	msg := CommandMessage(command, COMMAND_CREATE)
-	Pub[any](cc.Bus, "command", msg)
-
-	err = cc.Runner.Run(cc.DB, command)
-	if err != nil {
-		slog.Error("NewCommandHandler cc.Runner.Run", "error", err)
+	command, err = cc.Dispatcher.Submit(command)
+	if errors.Is(err, ErrUnknownQueue) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if command == nil {
+		slog.Error("NewCommandHandler cc.Dispatcher.Submit", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	} else if err != nil {
+		slog.Error("NewCommandHandler cc.Dispatcher.Submit", "error", err)
 		return cc.String(http.StatusInternalServerError, "runner fail")
 	}
 
 	return cc.JSON(http.StatusCreated, command)
 }
 
+type CommandInfo struct {
+	*Command
+	// the original command and all of its reruns, oldest first
+	Lineage []Command `json:"lineage"`
+}
+
 func GetCommandHandler(c echo.Context) error {
 	cc := c.(*CockpitContext)
 
 	commandId := cc.Param("id")
-	info, err := cc.DB.GetCommand(commandId)
+	command, err := cc.DB.GetCommand(commandId)
 	if err != nil {
 		slog.Error("GetCommandHandler cc.DB.GetCommand", "error", err)
 		return cc.String(http.StatusInternalServerError, "db fail")
 	}
-	return cc.JSON(http.StatusOK, info)
+
+	lineage, err := cc.DB.GetLineage(commandId)
+	if err != nil {
+		slog.Error("GetCommandHandler cc.DB.GetLineage", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, CommandInfo{Command: command, Lineage: lineage})
+}
+
+// copy of `command` to be run again, linked back to it
+func RerunOf(command *Command) *Command {
+	return &Command{
+		Command:    command.Command,
+		TimeoutMs:  command.TimeoutMs,
+		Cwd:        command.Cwd,
+		Env:        command.Env,
+		Queue:      command.Queue,
+		RerunOf:    &command.Id,
+		Retry:      command.Retry,
+		Tty:        command.Tty,
+		TtyRows:    command.TtyRows,
+		TtyCols:    command.TtyCols,
+		Stdin:      command.Stdin,
+		Limits:     command.Limits,
+		Exec:       command.Exec,
+		TemplateId: command.TemplateId,
+	}
+}
+
+func RerunCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	original, err := cc.DB.GetCommand(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "command not found")
+	} else if err != nil {
+		slog.Error("RerunCommandHandler cc.DB.GetCommand", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	command, err := cc.Dispatcher.Submit(RerunOf(original))
+	if errors.Is(err, ErrUnknownQueue) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if command == nil {
+		slog.Error("RerunCommandHandler cc.Dispatcher.Submit", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	} else if err != nil {
+		slog.Error("RerunCommandHandler cc.Dispatcher.Submit", "error", err)
+		return cc.String(http.StatusInternalServerError, "runner fail")
+	}
+
+	return cc.JSON(http.StatusCreated, command)
 }
 
 func ListCommandHandler(c echo.Context) error {
@@ -75,6 +342,10 @@ func ListCommandHandler(c echo.Context) error {
 
 type StopCommand struct {
 	Command string `json:"command"`
+	// signal sent first, defaults to SIGTERM
+	Signal string `json:"signal"`
+	// grace period before SIGKILL as a duration string like `30s`
+	Grace string `json:"grace"`
 }
 
 func StopCommandHandler(c echo.Context) error {
@@ -85,8 +356,27 @@ func StopCommandHandler(c echo.Context) error {
 		return cc.String(http.StatusBadRequest, "invalid json format")
 	}
 
+	var policy StopPolicy
+	if len(stopCommand.Signal) > 0 {
+		sig, err := ParseSignal(stopCommand.Signal)
+		if err != nil {
+			return cc.String(http.StatusBadRequest, "invalid signal")
+		}
+		if !slices.Contains(STOP_SIGNALS, sig) {
+			return cc.String(http.StatusBadRequest, fmt.Sprintf("%s cannot stop a command", SignalName(sig)))
+		}
+		policy.Signal = sig
+	}
+	if len(stopCommand.Grace) > 0 {
+		grace, err := time.ParseDuration(stopCommand.Grace)
+		if err != nil || grace <= 0 {
+			return cc.String(http.StatusBadRequest, "invalid grace period")
+		}
+		policy.Grace = grace
+	}
+
 	id := stopCommand.Command
-	err := cc.Runner.Stop(id)
+	err := cc.Runner.Stop(id, policy)
 	if err != nil {
 		slog.Error("StopCommandHandler cc.Runner.Stop", "error", err)
 		return cc.String(http.StatusInternalServerError, "runner fail")
@@ -95,6 +385,35 @@ func StopCommandHandler(c echo.Context) error {
 	return cc.NoContent(http.StatusOK)
 }
 
+type SignalCommand struct {
+	// signal name or number like `SIGSTOP`, `cont` or `10`
+	Signal string `json:"signal"`
+}
+
+// send a signal to the process group of a running command,
+// SIGSTOP pauses it and SIGCONT resumes it
+func SignalCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	signalCommand := new(SignalCommand)
+	if err := cc.Bind(signalCommand); err != nil {
+		slog.Error("SignalCommandHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	sig, err := ParseSignal(signalCommand.Signal)
+	if err != nil {
+		return cc.String(http.StatusBadRequest, "invalid signal")
+	}
+
+	err = cc.Runner.Signal(cc.Param("id"), sig)
+	if err != nil {
+		slog.Error("SignalCommandHandler cc.Runner.Signal", "error", err)
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
 type DeleteCommand struct {
 	Command string `json:"command"`
 }
@@ -114,7 +433,7 @@ func DeleteCommandHandler(c echo.Context) error {
 		return cc.String(http.StatusInternalServerError, "db fail")
 	}
 
-	if !(command.Status == COMMAND_ERROR || command.Status == COMMAND_EXITED) {
+	if !command.Status.IsFinished() {
 		return cc.String(http.StatusBadRequest, "command still running")
 	}
 
@@ -130,6 +449,88 @@ func DeleteCommandHandler(c echo.Context) error {
 	return cc.NoContent(http.StatusOK)
 }
 
+// largest terminal size accepted
+const MAX_TTY_SIZE = 1000
+
+func ValidateTtySize(rows int, cols int) error {
+	if rows <= 0 || rows > MAX_TTY_SIZE || cols <= 0 || cols > MAX_TTY_SIZE {
+		return fmt.Errorf("invalid terminal size %dx%d", rows, cols)
+	}
+	return nil
+}
+
+type ResizeCommand struct {
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+func ResizeCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	resizeCommand := new(ResizeCommand)
+	if err := cc.Bind(resizeCommand); err != nil {
+		slog.Error("ResizeCommandHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	if err := ValidateTtySize(resizeCommand.Rows, resizeCommand.Cols); err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	err := cc.Runner.Resize(cc.Param("id"), uint16(resizeCommand.Rows), uint16(resizeCommand.Cols))
+	if err != nil {
+		slog.Error("ResizeCommandHandler cc.Runner.Resize", "error", err)
+		return cc.String(http.StatusInternalServerError, "runner fail")
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
+type CommandInput struct {
+	// raw input written as is
+	Data string `json:"data"`
+	// input written followed by a newline
+	Line *string `json:"line"`
+	// do not record the input in the log, for passwords
+	Secret bool `json:"secret"`
+}
+
+func InputCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	commandInput := new(CommandInput)
+	if err := cc.Bind(commandInput); err != nil {
+		slog.Error("InputCommandHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	data := commandInput.Data
+	if commandInput.Line != nil {
+		data += *commandInput.Line + "\n"
+	}
+	if len(data) == 0 {
+		return cc.String(http.StatusBadRequest, "empty input")
+	}
+
+	err := cc.Runner.Input(cc.Param("id"), []byte(data), commandInput.Secret)
+	if err != nil {
+		slog.Error("InputCommandHandler cc.Runner.Input", "error", err)
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
+func CloseInputCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	err := cc.Runner.CloseInput(cc.Param("id"))
+	if err != nil {
+		slog.Error("CloseInputCommandHandler cc.Runner.CloseInput", "error", err)
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
 func CommandStreamHandler(c echo.Context) error {
 	cc := c.(*CockpitContext)
 
@@ -186,6 +587,24 @@ func LogHandler(c echo.Context) error {
 	return cc.JSON(http.StatusOK, logs)
 }
 
+// counters of the batched log writer, dropped logs mean the db cannot keep up
+func LogStatsHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	return cc.JSON(http.StatusOK, cc.DB.LogStats())
+}
+
+// rebuild the database file to give back the space of deleted commands
+func VacuumHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	result, err := cc.DB.Vacuum()
+	if err != nil {
+		slog.Error("VacuumHandler cc.DB.Vacuum", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, result)
+}
+
 func LogStreamHandler(c echo.Context) error {
 	cc := c.(*CockpitContext)
 	commandId := cc.Param("id")
@@ -222,6 +641,58 @@ func LogStreamHandler(c echo.Context) error {
 	}
 }
 
+func ResourcesHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	samples, err := cc.DB.GetResourceSamples(cc.Param("id"))
+	if err != nil {
+		slog.Error("ResourcesHandler cc.DB.GetResourceSamples", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.JSON(http.StatusOK, samples)
+}
+
+// live resource samples of a running command, ends when the command finishes
+func ResourceStreamHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	commandId := cc.Param("id")
+
+	rc, unsub, err := SubChan[*ResourceSample](cc.Bus, ResourceTopic(commandId))
+	if err != nil {
+		slog.Error("ResourceStreamHandler SubChan", "error", err)
+		return cc.String(http.StatusInternalServerError, "runner fail")
+	}
+
+	w := cc.Response()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		select {
+		case <-cc.Request().Context().Done():
+			unsub()
+			return nil
+		case sample, ok := <-rc:
+			if !ok {
+				return nil
+			}
+			data, err := json.Marshal(sample)
+			if err != nil {
+				slog.Error("ResourceStreamHandler json.Marshal(sample)", "error", err)
+				continue
+			}
+			event := Event{Data: data}
+
+			if err := event.MarshalTo(w); err != nil {
+				return err
+			}
+			w.Flush()
+		}
+	}
+}
+
 func TestSSE(c echo.Context) error {
 	slog.Info("SSE client connected, ip: %v", c.RealIP(), "info")
 	w := c.Response()
@@ -247,4 +718,3 @@ func TestSSE(c echo.Context) error {
 		}
 	}
 }
-
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type IoClass string
+
+const (
+	IO_CLASS_REALTIME    IoClass = "realtime"
+	IO_CLASS_BEST_EFFORT IoClass = "best-effort"
+	IO_CLASS_IDLE        IoClass = "idle"
+)
+
+// ioprio class values of ioprio_set(2)
+var IO_CLASSES = map[IoClass]int{
+	IO_CLASS_REALTIME:    1,
+	IO_CLASS_BEST_EFFORT: 2,
+	IO_CLASS_IDLE:        3,
+}
+
+// Resource limits of a command. Memory, cpu and process limits are enforced
+// by a cgroup v2 when the runner has one, otherwise through rlimits set
+// before the command execs where possible. Zero fields are not limited.
+type Limits struct {
+	// RLIMIT_AS without a cgroup, which counts virtual memory
+	MemoryBytes int64 `json:"memoryBytes"`
+	// cpu time per second of wall time, 1.5 is one and a half cores.
+	// requires a cgroup
+	Cpus float64 `json:"cpus"`
+	// RLIMIT_NPROC without a cgroup, which counts every process of the user
+	MaxProcesses int64   `json:"maxProcesses"`
+	MaxOpenFiles int64   `json:"maxOpenFiles"`
+	Nice         *int    `json:"nice"`
+	IoClass      IoClass `json:"ioClass"`
+	// 0 is the highest and 7 the lowest priority within the class
+	IoPriority *int `json:"ioPriority"`
+}
+
+func (l *Limits) Value() (driver.Value, error) {
+	if l == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *Limits) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	default:
+		return fmt.Errorf("cannot scan %T into Limits", src)
+	}
+}
+
+func (l *Limits) Validate() error {
+	if l.MemoryBytes < 0 || l.Cpus < 0 || l.MaxProcesses < 0 || l.MaxOpenFiles < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if l.Nice != nil && (*l.Nice < -20 || *l.Nice > 19) {
+		return fmt.Errorf("nice must be between -20 and 19")
+	}
+	if _, found := IO_CLASSES[l.IoClass]; len(l.IoClass) > 0 && !found {
+		return fmt.Errorf("invalid io class %s", l.IoClass)
+	}
+	if l.IoPriority != nil {
+		if len(l.IoClass) == 0 {
+			return fmt.Errorf("ioPriority requires ioClass")
+		}
+		if *l.IoPriority < 0 || *l.IoPriority > 7 {
+			return fmt.Errorf("ioPriority must be between 0 and 7")
+		}
+	}
+	return nil
+}
+
+// parse a size like `512M`, `2GiB` or a number of bytes
+func ParseByteSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	idx := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := size, "B"
+	if idx >= 0 {
+		number, unit = size[:idx], strings.TrimSpace(size[idx:])
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	multiple, ok := parseByteUnit(unit)
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * multiple), nil
+}
+
+// rlimit of a command, named like the options of prlimit(1)
+type rlimit struct {
+	resource int
+	name     string
+	value    int64
+	// ulimit option, the value is in KiB for `-v`
+	ulimit string
+}
+
+// rlimits covering what `cgroup` does not, all of them without one
+func (l *Limits) rlimits(cgroup *Cgroup) []rlimit {
+	limits := []rlimit{}
+	if l.MaxOpenFiles > 0 {
+		limits = append(limits, rlimit{unix.RLIMIT_NOFILE, "nofile", l.MaxOpenFiles, "n"})
+	}
+	if cgroup == nil {
+		if l.MemoryBytes > 0 {
+			limits = append(limits, rlimit{unix.RLIMIT_AS, "as", l.MemoryBytes, "v"})
+		}
+		if l.MaxProcesses > 0 {
+			limits = append(limits, rlimit{unix.RLIMIT_NPROC, "nproc", l.MaxProcesses, "u"})
+		}
+	}
+	return limits
+}
+
+// Run `args` through prlimit or else bash, which set the rlimits on
+// themselves and exec the command, so nothing it forks escapes them.
+// false if there is nothing to set or neither program is found, Apply
+// then sets the rlimits after the start.
+func (l *Limits) WrapArgs(args []string, cgroup *Cgroup) ([]string, bool) {
+	limits := l.rlimits(cgroup)
+	if len(limits) == 0 {
+		return args, false
+	}
+	if path, err := exec.LookPath("prlimit"); err == nil {
+		return prlimitArgs(path, limits, args), true
+	}
+	if path, err := exec.LookPath("bash"); err == nil {
+		return ulimitArgs(path, limits, args), true
+	}
+	return args, false
+}
+
+func prlimitArgs(prlimit string, limits []rlimit, args []string) []string {
+	wrapped := []string{prlimit}
+	for _, limit := range limits {
+		// a single value is both the soft and the hard limit
+		wrapped = append(wrapped, fmt.Sprintf("--%s=%d", limit.name, limit.value))
+	}
+	wrapped = append(wrapped, "--")
+	return append(wrapped, args...)
+}
+
+func ulimitArgs(bash string, limits []rlimit, args []string) []string {
+	script := ""
+	for _, limit := range limits {
+		value := limit.value
+		if limit.ulimit == "v" {
+			value = max(value/1024, 1)
+		}
+		script += fmt.Sprintf("ulimit -%s %d && ", limit.ulimit, value)
+	}
+	script += `exec "$@"`
+	wrapped := []string{bash, "-c", script, "cockpit-limits"}
+	return append(wrapped, args...)
+}
+
+// Apply the limits a cgroup does not cover to the started process.
+// rlimits are only set here when `wrapped` is false, then anything the
+// process forked before keeps the server's limits. nice and ionice apply
+// to the whole process group.
+func (l *Limits) Apply(pid int, pgid int, cgroup *Cgroup, wrapped bool) []error {
+	errs := []error{}
+	if !wrapped {
+		for _, limit := range l.rlimits(cgroup) {
+			value := &unix.Rlimit{Cur: uint64(limit.value), Max: uint64(limit.value)}
+			if err := unix.Prlimit(pid, limit.resource, value, nil); err != nil {
+				errs = append(errs, fmt.Errorf("setrlimit %s: %w", limit.name, err))
+			}
+		}
+	}
+	if cgroup == nil && l.Cpus > 0 {
+		errs = append(errs, fmt.Errorf("cpu quota requires cgroup v2, not applied"))
+	}
+
+	if l.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PGRP, pgid, *l.Nice); err != nil {
+			errs = append(errs, fmt.Errorf("setpriority: %w", err))
+		}
+	}
+	if len(l.IoClass) > 0 {
+		priority := 4
+		if l.IoPriority != nil {
+			priority = *l.IoPriority
+		}
+		if err := IoprioSet(pgid, IO_CLASSES[l.IoClass], priority); err != nil {
+			errs = append(errs, fmt.Errorf("ioprio_set: %w", err))
+		}
+	}
+	return errs
+}
+
+// IOPRIO_WHO_PGRP of ioprio_set(2)
+const IOPRIO_WHO_PGRP = 2
+
+// set the io scheduling class and priority of a process group
+func IoprioSet(pgid int, class int, priority int) error {
+	ioprio := class<<13 | priority
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, IOPRIO_WHO_PGRP, uintptr(pgid), uintptr(ioprio))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
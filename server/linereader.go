@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// longest line stored as one log, longer lines are split into chunks
+const DEFAULT_MAX_LINE_LENGTH = 16 * 1024
+
+// how long output without a trailing newline waits before it is flushed
+const DEFAULT_LINE_FLUSH_DELAY = 500 * time.Millisecond
+
+var DefaultLineReader = LineReader{
+	MaxLength:  DEFAULT_MAX_LINE_LENGTH,
+	FlushDelay: DEFAULT_LINE_FLUSH_DELAY,
+}
+
+// Line of output. A line is emitted again with the same id and the new
+// content when it is overwritten by `\r` or when more of a flushed partial
+// line arrives, until it is complete.
+type Line struct {
+	Id        string
+	CreatedAt string
+	Content   string
+	// terminated by a newline, the max length or the end of output
+	Complete bool
+}
+
+// Splits output into lines. Unlike bufio.Scanner it has no line length
+// limit, keeps only the last `\r` separated update of a progress line and
+// does not hold back output that is not followed by a newline.
+type LineReader struct {
+	MaxLength  int
+	FlushDelay time.Duration
+}
+
+type lineState struct {
+	id        string
+	createdAt string
+	buf       []byte
+	// a `\r` was read, the next byte starts the line over
+	overwrite bool
+	// content changed since the line was last emitted
+	dirty bool
+}
+
+func (l *lineState) emit(complete bool, cb func(Line)) {
+	if len(l.id) == 0 {
+		l.id = IdGen()
+		l.createdAt = FormatNow()
+	}
+	cb(Line{Id: l.id, CreatedAt: l.createdAt, Content: string(l.buf), Complete: complete})
+
+	l.dirty = false
+	if complete {
+		*l = lineState{buf: l.buf[:0]}
+	}
+}
+
+// emit the first `n` bytes as a complete line and keep the rest
+func (l *lineState) split(n int, cb func(Line)) {
+	rest := append([]byte(nil), l.buf[n:]...)
+	l.buf = l.buf[:n]
+	l.emit(true, cb)
+	l.buf = append(l.buf, rest...)
+	l.dirty = len(rest) > 0
+}
+
+func (r *LineReader) feed(l *lineState, data []byte, cb func(Line)) {
+	for _, b := range data {
+		switch b {
+		case '\n':
+			l.overwrite = false
+			l.emit(true, cb)
+		case '\r':
+			// emitted once the next byte shows it is not a `\r\n` line end
+			l.overwrite = true
+		default:
+			if l.overwrite {
+				if l.dirty {
+					l.emit(false, cb)
+				}
+				l.buf = l.buf[:0]
+				l.overwrite = false
+			}
+			if len(l.id) == 0 {
+				l.id = IdGen()
+				l.createdAt = FormatNow()
+			}
+			l.buf = append(l.buf, b)
+			l.dirty = true
+
+			if r.MaxLength > 0 && len(l.buf) >= r.MaxLength {
+				l.split(runeBoundary(l.buf), cb)
+			}
+		}
+	}
+}
+
+// length of `buf` without a trailing incomplete utf-8 sequence
+func runeBoundary(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) && i > 0 {
+				return i
+			}
+			break
+		}
+	}
+	return len(buf)
+}
+
+// read `reader` until EOF calling `cb` for every line or line update
+func (r *LineReader) ReadLines(reader io.Reader, cb func(Line)) error {
+	chunks := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+				chunks <- data
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	var line lineState
+	timer := time.NewTimer(r.FlushDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case data, ok := <-chunks:
+			if !ok {
+				if line.dirty || len(line.id) > 0 {
+					line.emit(true, cb)
+				}
+				return <-errc
+			}
+			r.feed(&line, data, cb)
+			if line.dirty && r.FlushDelay > 0 {
+				timer.Reset(r.FlushDelay)
+			}
+		case <-timer.C:
+			if line.dirty {
+				line.emit(false, cb)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readLines(r *LineReader, input string) []Line {
+	lines := []Line{}
+	r.ReadLines(strings.NewReader(input), func(line Line) {
+		lines = append(lines, line)
+	})
+	return lines
+}
+
+// content of the last update of every line
+func finalContents(lines []Line) []string {
+	contents := []string{}
+	ids := []string{}
+	for _, line := range lines {
+		if i := slices.Index(ids, line.Id); i >= 0 {
+			contents[i] = line.Content
+			continue
+		}
+		ids = append(ids, line.Id)
+		contents = append(contents, line.Content)
+	}
+	return contents
+}
+
+func TestLineReader(t *testing.T) {
+	r := &LineReader{MaxLength: 8, FlushDelay: 50 * time.Millisecond}
+
+	lines := readLines(r, "one\r\ntwo\n\nthree")
+	if got := finalContents(lines); !slices.Equal(got, []string{"one", "two", "", "three"}) {
+		t.Errorf("unexpected lines %q\n", got)
+	}
+	if !lines[len(lines)-1].Complete {
+		t.Errorf("expected the last line to be complete at EOF\n")
+	}
+
+	lines = readLines(r, " 10%\r 50%\r100%\ndone\n")
+	if got := finalContents(lines); !slices.Equal(got, []string{"100%", "done"}) {
+		t.Errorf("unexpected progress lines %q\n", got)
+	}
+	if len(lines) != 4 || lines[0].Complete || lines[0].Content != " 10%" {
+		t.Errorf("expected every progress update to be emitted, got %+v\n", lines)
+	}
+
+	lines = readLines(r, "0123456789abcdefXYZ\n")
+	if got := finalContents(lines); !slices.Equal(got, []string{"01234567", "89abcdef", "XYZ"}) {
+		t.Errorf("unexpected chunks %q\n", got)
+	}
+
+	// a multi-byte rune is not split across chunks
+	lines = readLines(r, "abcdefg한글\n")
+	if got := finalContents(lines); !slices.Equal(got, []string{"abcdefg", "한글"}) {
+		t.Errorf("unexpected utf-8 chunks %q\n", got)
+	}
+
+	pr, pw := io.Pipe()
+	updates := make(chan Line, 10)
+	go r.ReadLines(pr, func(line Line) { updates <- line })
+
+	pw.Write([]byte("ok> "))
+	select {
+	case line := <-updates:
+		if line.Complete || line.Content != "ok> " {
+			t.Errorf("unexpected idle flush %+v\n", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("partial line was not flushed\n")
+	}
+
+	pw.Write([]byte("yes\n"))
+	pw.Close()
+	line := <-updates
+	if !line.Complete || line.Content != "ok> yes" {
+		t.Errorf("expected the flushed line to be completed, got %+v\n", line)
+	}
+}
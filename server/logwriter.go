@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// most logs committed in one transaction
+const LOG_BATCH_SIZE = 256
+
+// longest a queued log waits for its batch to be committed
+const LOG_BATCH_INTERVAL = 50 * time.Millisecond
+
+// logs waiting to be committed before writers have to wait
+const LOG_QUEUE_SIZE = 4096
+
+// how long a writer waits for room in a full queue before the log is dropped
+const LOG_MAX_WAIT = 1 * time.Second
+
+var ErrLogDropped = errors.New("log queue is full, log dropped")
+
+// Counters of the log writer since the server started
+type LogWriterStats struct {
+	// logs waiting in the queue right now
+	Queued  int    `json:"queued"`
+	Written uint64 `json:"written"`
+	Batches uint64 `json:"batches"`
+	// writes that found the queue full and had to wait
+	Blocked uint64 `json:"blocked"`
+	// logs given up on after waiting LOG_MAX_WAIT
+	Dropped uint64 `json:"dropped"`
+	// logs that failed to be inserted
+	Failed uint64 `json:"failed"`
+}
+
+// Commits queued logs in batched transactions, bounded by LOG_BATCH_SIZE
+// and LOG_BATCH_INTERVAL. A full queue blocks writers for up to LOG_MAX_WAIT,
+// which slows down the draining of the command's output, after that logs
+// are dropped and counted per command until it is flushed.
+type LogWriter struct {
+	db    *sql.DB
+	queue chan logRequest
+
+	mu sync.Mutex
+	// logs dropped or lost per command since its last flush
+	lost map[string]int
+
+	written atomic.Uint64
+	batches atomic.Uint64
+	blocked atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// a log to write or, with `flushed` set, a request to commit everything queued before it
+type logRequest struct {
+	log     *Log
+	flushed chan struct{}
+}
+
+func NewLogWriter(db *sql.DB) *LogWriter {
+	w := &LogWriter{
+		db:    db,
+		queue: make(chan logRequest, LOG_QUEUE_SIZE),
+		lost:  map[string]int{},
+	}
+	go w.run()
+	return w
+}
+
+// queue `log` to be committed, fails with ErrLogDropped if the queue stayed full
+func (w *LogWriter) Write(log *Log) error {
+	select {
+	case w.queue <- logRequest{log: log}:
+		return nil
+	default:
+	}
+
+	w.blocked.Add(1)
+	timer := time.NewTimer(LOG_MAX_WAIT)
+	defer timer.Stop()
+	select {
+	case w.queue <- logRequest{log: log}:
+		return nil
+	case <-timer.C:
+		w.dropped.Add(1)
+		w.addLost(log.CommandId, 1)
+		return ErrLogDropped
+	}
+}
+
+// commit every log queued so far, returns how many logs of `commandId`
+// were dropped or lost since its last flush
+func (w *LogWriter) Flush(commandId string) int {
+	flushed := make(chan struct{})
+	w.queue <- logRequest{flushed: flushed}
+	<-flushed
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	lost := w.lost[commandId]
+	delete(w.lost, commandId)
+	return lost
+}
+
+func (w *LogWriter) Stats() LogWriterStats {
+	return LogWriterStats{
+		Queued:  len(w.queue),
+		Written: w.written.Load(),
+		Batches: w.batches.Load(),
+		Blocked: w.blocked.Load(),
+		Dropped: w.dropped.Load(),
+		Failed:  w.failed.Load(),
+	}
+}
+
+func (w *LogWriter) addLost(commandId string, n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lost[commandId] += n
+}
+
+func (w *LogWriter) run() {
+	batch := make([]*Log, 0, LOG_BATCH_SIZE)
+	var deadline <-chan time.Time
+	commit := func() {
+		if len(batch) > 0 {
+			w.commit(batch)
+			batch = batch[:0]
+		}
+		deadline = nil
+	}
+
+	for {
+		select {
+		case req := <-w.queue:
+			if req.log != nil {
+				batch = append(batch, req.log)
+				if len(batch) == 1 {
+					deadline = time.After(LOG_BATCH_INTERVAL)
+				}
+				if len(batch) >= LOG_BATCH_SIZE {
+					commit()
+				}
+			}
+			if req.flushed != nil {
+				commit()
+				close(req.flushed)
+			}
+		case <-deadline:
+			commit()
+		}
+	}
+}
+
+func (w *LogWriter) commit(batch []*Log) {
+	if err := w.insert(batch); err != nil {
+		// one bad log, like one of a command deleted meanwhile, must not
+		// take the rest of the batch with it
+		slog.Error("failed to commit log batch, inserting one by one", "logs", len(batch), "error", err)
+		w.insertEach(batch)
+		return
+	}
+	w.written.Add(uint64(len(batch)))
+	w.batches.Add(1)
+}
+
+func (w *LogWriter) insertEach(batch []*Log) {
+	for _, log := range batch {
+		_, err := w.db.Exec(INSERT_LOG_QUERY, log.Id, log.CommandId, log.CreatedAt, log.Content, log.FD)
+		if err != nil {
+			slog.Error("failed to insert log", "commandId", log.CommandId, "error", err)
+			w.failed.Add(1)
+			w.addLost(log.CommandId, 1)
+			continue
+		}
+		w.written.Add(1)
+	}
+	w.batches.Add(1)
+}
+
+func (w *LogWriter) insert(batch []*Log) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(INSERT_LOG_QUERY)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, log := range batch {
+		_, err := stmt.Exec(log.Id, log.CommandId, log.CreatedAt, log.Content, log.FD)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	bus := NewEventBus()
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	command, err := db.NewCommand(&Command{Command: "yes"})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	before := db.LogStats()
+	n := LOG_BATCH_SIZE*2 + 10
+	for i := range n {
+		log := &Log{IdGen(), command.Id, FormatNow(), fmt.Sprintf("line %d", i), LOG_STDOUT}
+		if err := db.QueueLog(log); err != nil {
+			t.Fatalf("QueueLog error: %s\n", err)
+		}
+	}
+	if dropped := db.FlushLogs(command.Id); dropped != 0 {
+		t.Errorf("expected no dropped logs, got %d\n", dropped)
+	}
+
+	logs, err := db.GetLogs(command.Id, "", uint(n+1))
+	if err != nil {
+		t.Fatalf("db GetLogs error: %s\n", err)
+	}
+	if len(logs) != n || logs[0].Content != fmt.Sprintf("line %d", n-1) {
+		t.Errorf("expected %d logs after flush, got %d\n", n, len(logs))
+	}
+
+	after := db.LogStats()
+	if after.Written-before.Written != uint64(n) {
+		t.Errorf("expected %d written logs, got %d\n", n, after.Written-before.Written)
+	}
+	if batches := after.Batches - before.Batches; batches < 3 || batches > uint64(n) {
+		t.Errorf("unexpected number of batches %d\n", batches)
+	}
+}
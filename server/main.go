@@ -2,8 +2,10 @@ package main
 
 import (
 	_ "embed"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -13,23 +15,50 @@ import (
 var IndexHTML string
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(MigrateCommand(os.Args[2:], os.Stdout))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %s\nusage: cockpit [migrate status]\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	bus := NewEventBus()
 	CreateTopic[any](bus, "command")
+	CreateTopic[*WorkflowEvent](bus, "workflow")
 	runner := NewRunner(bus)
-	db, err := NewDB("file:cockpit.db", bus)
+	db, err := NewDB(DATA_SOURCE_NAME, bus)
 	if err != nil {
 		slog.Error("failed to init db", "error", err)
 		return
 	}
+	if err := RecoverCommands(db, runner, bus); err != nil {
+		slog.Error("failed to recover commands", "error", err)
+		return
+	}
+	dispatcher := NewDispatcher(db, runner, bus)
+	go dispatcher.Start()
+	scheduler := NewScheduler(db, dispatcher)
+	go scheduler.Start()
+	janitor := NewJanitor(db, bus)
+	go janitor.Start()
 
 	e := echo.New()
 
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.DefaultCORSConfig))
-	e.Use(CockpitContextMiddleware(runner, db, bus))
+	e.Use(CockpitContextMiddleware(runner, db, bus, dispatcher, scheduler, janitor))
 
 	e.GET("/test/sse", TestSSE)
+	e.GET("/api/v1/log/stats", LogStatsHandler)
+	e.POST("/api/v1/db/vacuum", VacuumHandler)
+	e.GET("/api/v1/retention", GetRetentionHandler)
+	e.PUT("/api/v1/retention", SaveRetentionHandler)
+	e.POST("/api/v1/retention/run", RunRetentionHandler)
+	e.GET("/api/v1/search", SearchHandler)
 	e.POST("/api/v1/command/new", NewCommandHandler)
 	e.GET("/api/v1/command/:id", GetCommandHandler)
 	e.GET("/api/v1/command/list", ListCommandHandler)
@@ -38,6 +67,37 @@ func main() {
 	e.GET("/api/v1/command/stream", CommandStreamHandler)
 	e.GET("/api/v1/command/:id/log/stream", LogStreamHandler)
 	e.GET("/api/v1/command/:id/log", LogHandler)
+	e.GET("/api/v1/command/:id/resources", ResourcesHandler)
+	e.GET("/api/v1/command/:id/resources/stream", ResourceStreamHandler)
+	e.POST("/api/v1/command/:id/cancel", CancelCommandHandler)
+	e.POST("/api/v1/command/:id/rerun", RerunCommandHandler)
+	e.POST("/api/v1/command/:id/resize", ResizeCommandHandler)
+	e.POST("/api/v1/command/:id/stdin", InputCommandHandler)
+	e.POST("/api/v1/command/:id/stdin/close", CloseInputCommandHandler)
+	e.POST("/api/v1/command/:id/signal", SignalCommandHandler)
+	e.POST("/api/v1/command/:id/pin", PinCommandHandler)
+	e.POST("/api/v1/command/:id/unpin", UnpinCommandHandler)
+	e.GET("/api/v1/command/:id/terminal", TerminalHandler)
+	e.POST("/api/v1/queue/new", SaveQueueHandler)
+	e.GET("/api/v1/queue/list", ListQueueHandler)
+	e.GET("/api/v1/queue/:name", GetQueueHandler)
+	e.POST("/api/v1/queue/:name/reorder", ReorderQueueHandler)
+	e.DELETE("/api/v1/queue/:name", DeleteQueueHandler)
+	e.POST("/api/v1/schedule/new", NewScheduleHandler)
+	e.GET("/api/v1/schedule/list", ListScheduleHandler)
+	e.GET("/api/v1/schedule/:id", GetScheduleHandler)
+	e.PUT("/api/v1/schedule/:id", UpdateScheduleHandler)
+	e.DELETE("/api/v1/schedule/:id", DeleteScheduleHandler)
+	e.POST("/api/v1/workflow/new", NewWorkflowHandler)
+	e.GET("/api/v1/workflow/list", ListWorkflowHandler)
+	e.GET("/api/v1/workflow/stream", WorkflowStreamHandler)
+	e.GET("/api/v1/workflow/:id", GetWorkflowHandler)
+	e.POST("/api/v1/template/new", NewTemplateHandler)
+	e.GET("/api/v1/template/list", ListTemplateHandler)
+	e.GET("/api/v1/template/:id", GetTemplateHandler)
+	e.PUT("/api/v1/template/:id", UpdateTemplateHandler)
+	e.DELETE("/api/v1/template/:id", DeleteTemplateHandler)
+	e.POST("/api/v1/template/:id/run", RunTemplateHandler)
 
 	e.GET("/*", func(c echo.Context) error {
 		return c.HTML(http.StatusOK, IndexHTML)
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+)
+
+// Change of the database schema, applied once in a transaction of its own
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// Every schema change is a new migration at the end with the next version.
+// Migrations that shipped must never be edited, databases that already
+// applied them would not see the change.
+var MIGRATIONS = []Migration{
+	{Version: 1, Name: "baseline", Up: migrateBaseline},
+	{Version: 2, Name: "retention", Up: migrateRetention},
+	{Version: 3, Name: "search", Up: migrateSearch},
+	{Version: 4, Name: "retry at", Up: migrateRetryAt},
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this build")
+
+const SCHEMA_VERSION_TABLE_NAME = "schema_version"
+const CREATE_SCHEMA_VERSION_TABLE_QUERY = `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TEXT NOT NULL
+);
+`
+const SELECT_SCHEMA_VERSION_QUERY = `
+SELECT version, name, applied_at
+FROM schema_version
+ORDER BY version;
+`
+const INSERT_SCHEMA_VERSION_QUERY = `
+INSERT INTO schema_version (version, name, applied_at)
+VALUES (?, ?, ?);
+`
+const FOREIGN_KEY_CHECK_QUERY = "PRAGMA foreign_key_check;"
+
+// Migration as recorded in the database or known to this build
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// nil while the migration is pending
+	AppliedAt *string
+	// applied by a newer build
+	Unknown bool
+}
+
+// Apply the migrations newer than the schema of `db` in order, fails with
+// ErrSchemaTooNew if the database was migrated by a newer build
+func Migrate(db *sql.DB, migrations []Migration) error {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			return fmt.Errorf("migration %d is out of order", migrations[i].Version)
+		}
+	}
+
+	ctx := context.Background()
+	// foreign keys can only be switched outside of a transaction,
+	// so every migration runs on the same connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, CREATE_SCHEMA_VERSION_TABLE_QUERY); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if len(applied) > 0 {
+		version = applied[len(applied)-1].Version
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if version > latest {
+		return fmt.Errorf("%w: version %d, latest known %d", ErrSchemaTooNew, version, latest)
+	}
+	if version == latest {
+		return nil
+	}
+
+	// rebuilding a table would otherwise trip over the foreign keys
+	// pointing to it, they are checked before each commit instead
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF;"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON;")
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if err := applyMigration(ctx, conn, migration); err != nil {
+			return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+		slog.Info("applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := migration.Up(tx); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, FOREIGN_KEY_CHECK_QUERY)
+	if err != nil {
+		return err
+	}
+	broken := rows.Next()
+	rows.Close()
+	if broken {
+		return fmt.Errorf("foreign key violations left behind")
+	}
+
+	_, err = tx.ExecContext(ctx, INSERT_SCHEMA_VERSION_QUERY, migration.Version, migration.Name, FormatNow())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) ([]MigrationStatus, error) {
+	rows, err := conn.QueryContext(ctx, SELECT_SCHEMA_VERSION_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []MigrationStatus{}
+	for rows.Next() {
+		var m MigrationStatus
+		var appliedAt string
+		if err := rows.Scan(&m.Version, &m.Name, &appliedAt); err != nil {
+			return nil, err
+		}
+		m.AppliedAt = &appliedAt
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// Applied and pending migrations of `db` in version order, without
+// creating or changing anything
+func MigrationStatuses(db *sql.DB, migrations []Migration) ([]MigrationStatus, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied := []MigrationStatus{}
+	var schema string
+	err = conn.QueryRowContext(ctx, TABLE_SCHEMA_QUERY, SCHEMA_VERSION_TABLE_NAME).Scan(&schema)
+	if err != nil && !IsNoRows(err) {
+		return nil, err
+	}
+	if err == nil {
+		applied, err = appliedMigrations(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	appliedAt := map[int]*string{}
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt
+	}
+	statuses := []MigrationStatus{}
+	known := map[int]bool{}
+	for _, m := range migrations {
+		known[m.Version] = true
+		statuses = append(statuses, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: appliedAt[m.Version]})
+	}
+	for _, m := range applied {
+		if !known[m.Version] {
+			m.Unknown = true
+			statuses = append(statuses, m)
+		}
+	}
+	return statuses, nil
+}
+
+// `cockpit migrate status`, returns the exit code
+func MigrateCommand(args []string, w io.Writer) int {
+	if len(args) != 1 || args[0] != "status" {
+		fmt.Fprintln(w, "usage: cockpit migrate status")
+		return 2
+	}
+
+	db, err := OpenDB(DATA_SOURCE_NAME)
+	if err != nil {
+		return 1
+	}
+	defer db.Close()
+
+	statuses, err := MigrationStatuses(db, MIGRATIONS)
+	if err != nil {
+		slog.Error("failed to read schema version", "error", err)
+		return 1
+	}
+	printMigrationStatuses(w, statuses)
+	return 0
+}
+
+func printMigrationStatuses(w io.Writer, statuses []MigrationStatus) {
+	version, latest, pending, unknown := 0, 0, 0, 0
+	for _, m := range statuses {
+		if m.AppliedAt != nil && m.Version > version {
+			version = m.Version
+		}
+		if m.Unknown {
+			unknown++
+			continue
+		}
+		latest = m.Version
+		if m.AppliedAt == nil {
+			pending++
+		}
+	}
+
+	fmt.Fprintf(w, "schema version %d, latest %d, %d pending\n", version, latest, pending)
+	if unknown > 0 {
+		fmt.Fprintf(w, "the database was migrated by a newer build, the server will refuse to start\n")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, m := range statuses {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = *m.AppliedAt
+		}
+		if m.Unknown {
+			applied += " (unknown)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	tw.Flush()
+}
+
+// Schema of the last release before versioning. Tables are created if
+// missing, databases of older releases get their missing command columns
+// and the delete cascade of logs and resource samples. The SQL is a copy
+// frozen at version 1, later schema changes are migrations of their own.
+func migrateBaseline(tx *sql.Tx) error {
+	if _, err := tx.Exec(BASELINE_COMMAND_TABLE_QUERY); err != nil {
+		return fmt.Errorf("create command table: %w", err)
+	}
+	if _, err := tx.Exec(BASELINE_LOG_TABLE_QUERY); err != nil {
+		return fmt.Errorf("create log table: %w", err)
+	}
+	if err := addMissingColumns(tx, COMMAND_TABLE_NAME, BASELINE_COMMAND_ADDED_COLUMNS); err != nil {
+		return fmt.Errorf("add command table columns: %w", err)
+	}
+	// the workflow index is on command columns added above
+	if _, err := tx.Exec(BASELINE_TABLES_QUERY); err != nil {
+		return fmt.Errorf("create tables: %w", err)
+	}
+
+	if err := addDeleteCascade(tx, "log", BASELINE_LOG_TABLE_QUERY, BASELINE_LOG_COLUMNS); err != nil {
+		return fmt.Errorf("migrate log table: %w", err)
+	}
+	err := addDeleteCascade(tx, "resource_sample", BASELINE_RESOURCE_SAMPLE_TABLE_QUERY, BASELINE_RESOURCE_SAMPLE_COLUMNS)
+	if err != nil {
+		return fmt.Errorf("migrate resource_sample table: %w", err)
+	}
+	return nil
+}
+
+const BASELINE_COMMAND_TABLE_QUERY = `
+CREATE TABLE IF NOT EXISTS command (
+    id TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    command TEXT NOT NULL,
+    status TEXT NOT NULL,
+    exit_code INTEGER,
+    term_signal INTEGER,
+    started_at TEXT,
+    finished_at TEXT,
+    duration_ms INTEGER,
+    timeout_ms INTEGER,
+    deadline TEXT,
+    cwd TEXT NOT NULL DEFAULT '',
+    env TEXT NOT NULL DEFAULT '{}',
+    pid INTEGER,
+    pgid INTEGER,
+    queue TEXT NOT NULL DEFAULT '',
+    queue_position INTEGER,
+    rerun_of TEXT,
+    retry TEXT,
+    attempt INTEGER NOT NULL DEFAULT 1,
+    tty INTEGER NOT NULL DEFAULT 0,
+    tty_rows INTEGER,
+    tty_cols INTEGER,
+    stdin INTEGER NOT NULL DEFAULT 0,
+    peak_rss INTEGER,
+    limits TEXT,
+    term_reason TEXT,
+    exec TEXT,
+    workflow_id TEXT,
+    workflow_node TEXT NOT NULL DEFAULT '',
+    depends_on TEXT,
+    template_id TEXT
+);
+`
+
+// columns added to the command table after its first release
+var BASELINE_COMMAND_ADDED_COLUMNS = [][2]string{
+	{"exit_code", "INTEGER"},
+	{"term_signal", "INTEGER"},
+	{"started_at", "TEXT"},
+	{"finished_at", "TEXT"},
+	{"duration_ms", "INTEGER"},
+	{"timeout_ms", "INTEGER"},
+	{"deadline", "TEXT"},
+	{"cwd", "TEXT NOT NULL DEFAULT ''"},
+	{"env", "TEXT NOT NULL DEFAULT '{}'"},
+	{"pid", "INTEGER"},
+	{"pgid", "INTEGER"},
+	{"queue", "TEXT NOT NULL DEFAULT ''"},
+	{"queue_position", "INTEGER"},
+	{"rerun_of", "TEXT"},
+	{"retry", "TEXT"},
+	{"attempt", "INTEGER NOT NULL DEFAULT 1"},
+	{"tty", "INTEGER NOT NULL DEFAULT 0"},
+	{"tty_rows", "INTEGER"},
+	{"tty_cols", "INTEGER"},
+	{"stdin", "INTEGER NOT NULL DEFAULT 0"},
+	{"peak_rss", "INTEGER"},
+	{"limits", "TEXT"},
+	{"term_reason", "TEXT"},
+	{"exec", "TEXT"},
+	{"workflow_id", "TEXT"},
+	{"workflow_node", "TEXT NOT NULL DEFAULT ''"},
+	{"depends_on", "TEXT"},
+	{"template_id", "TEXT"},
+}
+
+const BASELINE_LOG_TABLE_QUERY = `
+CREATE TABLE IF NOT EXISTS log (
+    id TEXT PRIMARY KEY,
+    command_id TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    content TEXT NOT NULL,
+    fd INTEGER NOT NULL,
+    FOREIGN KEY (command_id) REFERENCES command (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS log_command_id ON log (command_id, id);
+`
+const BASELINE_LOG_COLUMNS = `
+id, command_id, created_at, content, fd
+`
+
+const BASELINE_RESOURCE_SAMPLE_TABLE_QUERY = `
+CREATE TABLE IF NOT EXISTS resource_sample (
+    id TEXT PRIMARY KEY,
+    command_id TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    cpu_percent REAL NOT NULL,
+    rss_bytes INTEGER NOT NULL,
+    read_bytes INTEGER NOT NULL,
+    write_bytes INTEGER NOT NULL,
+    threads INTEGER NOT NULL,
+    processes INTEGER NOT NULL,
+    FOREIGN KEY (command_id) REFERENCES command (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS resource_sample_command_id ON resource_sample (command_id, id);
+`
+const BASELINE_RESOURCE_SAMPLE_COLUMNS = `
+id, command_id, created_at, cpu_percent, rss_bytes, read_bytes, write_bytes, threads, processes
+`
+
+// queue, schedule, resource_sample, workflow and template
+const BASELINE_TABLES_QUERY = `
+CREATE TABLE IF NOT EXISTS queue (
+    name TEXT PRIMARY KEY,
+    max_concurrency INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS schedule (
+    id TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    name TEXT NOT NULL,
+    cron TEXT NOT NULL DEFAULT '',
+    run_at TEXT,
+    spec TEXT NOT NULL,
+    enabled INTEGER NOT NULL,
+    next_run TEXT,
+    last_run TEXT,
+    last_command_id TEXT
+);
+` + BASELINE_RESOURCE_SAMPLE_TABLE_QUERY + `
+CREATE TABLE IF NOT EXISTS workflow (
+    id TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    name TEXT NOT NULL,
+    status TEXT NOT NULL,
+    finished_at TEXT
+);
+CREATE INDEX IF NOT EXISTS command_workflow_id ON command (workflow_id);
+CREATE TABLE IF NOT EXISTS template (
+    id TEXT PRIMARY KEY,
+    created_at TEXT NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    command TEXT NOT NULL,
+    spec TEXT NOT NULL
+);
+`
+
+// add columns that are not yet present in `table`
+func addMissingColumns(tx *sql.Tx, table string, columns [][2]string) error {
+	rows, err := tx.Query(TABLE_COLUMNS_QUERY, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column[0], column[1])
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuild `table`, created before its foreign key to command had
+// ON DELETE CASCADE, with its current schema from `createQuery`.
+// Rows of deleted commands left behind until then are not copied over.
+func addDeleteCascade(tx *sql.Tx, table string, createQuery string, columns string) error {
+	var schema string
+	if err := tx.QueryRow(TABLE_SCHEMA_QUERY, table).Scan(&schema); err != nil {
+		return err
+	}
+	if strings.Contains(schema, "ON DELETE CASCADE") {
+		return nil
+	}
+
+	var orphans int64
+	orphanQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE command_id NOT IN (SELECT id FROM command);", table)
+	if err := tx.QueryRow(orphanQuery).Scan(&orphans); err != nil {
+		return err
+	}
+
+	old := table + "_old"
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", table, old),
+		createQuery,
+		fmt.Sprintf(
+			"INSERT INTO %s (%s) SELECT %s FROM %s WHERE command_id IN (SELECT id FROM command);",
+			table, columns, columns, old,
+		),
+		fmt.Sprintf("DROP TABLE %s;", old),
+		// indexes were dropped with the old table
+		createQuery,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("added delete cascade", "table", table, "orphans removed", orphans)
+	return nil
+}
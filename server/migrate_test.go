@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dsn := "file:" + t.TempDir() + "/migrate.db"
+	db, err := OpenDB(dsn)
+	if err != nil {
+		t.Fatalf("OpenDB error: %s\n", err)
+	}
+	defer db.Close()
+
+	migrations := []Migration{
+		{Version: 1, Name: "create", Up: func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE item (id TEXT PRIMARY KEY);")
+			return err
+		}},
+	}
+	if err := Migrate(db, migrations); err != nil {
+		t.Fatalf("Migrate error: %s\n", err)
+	}
+
+	t.Run("failed migration rolls back", func(t *testing.T) {
+		failing := append(migrations, Migration{Version: 2, Name: "broken", Up: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("ALTER TABLE item ADD COLUMN name TEXT;"); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO missing VALUES (1);")
+			return err
+		}})
+		if err := Migrate(db, failing); err == nil {
+			t.Fatalf("broken migration applied\n")
+		}
+		if _, err := db.Exec("SELECT name FROM item;"); err == nil {
+			t.Errorf("column of the broken migration was kept\n")
+		}
+		statuses, err := MigrationStatuses(db, failing)
+		if err != nil {
+			t.Fatalf("MigrationStatuses error: %s\n", err)
+		}
+		if statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+			t.Errorf("unexpected statuses %v\n", statuses)
+		}
+	})
+
+	t.Run("pending migrations apply in order", func(t *testing.T) {
+		order := []int{}
+		migrations = append(migrations,
+			Migration{Version: 2, Name: "add name", Up: func(tx *sql.Tx) error {
+				order = append(order, 2)
+				_, err := tx.Exec("ALTER TABLE item ADD COLUMN name TEXT;")
+				return err
+			}},
+			Migration{Version: 3, Name: "index name", Up: func(tx *sql.Tx) error {
+				order = append(order, 3)
+				_, err := tx.Exec("CREATE INDEX item_name ON item (name);")
+				return err
+			}},
+		)
+		if err := Migrate(db, migrations); err != nil {
+			t.Fatalf("Migrate error: %s\n", err)
+		}
+		if err := Migrate(db, migrations); err != nil {
+			t.Fatalf("second Migrate error: %s\n", err)
+		}
+		if len(order) != 2 || order[0] != 2 || order[1] != 3 {
+			t.Errorf("migrations ran as %v\n", order)
+		}
+	})
+
+	t.Run("newer schema is refused", func(t *testing.T) {
+		err := Migrate(db, migrations[:1])
+		if !errors.Is(err, ErrSchemaTooNew) {
+			t.Fatalf("expected ErrSchemaTooNew, got %v\n", err)
+		}
+
+		statuses, err := MigrationStatuses(db, migrations[:1])
+		if err != nil {
+			t.Fatalf("MigrationStatuses error: %s\n", err)
+		}
+		var out bytes.Buffer
+		printMigrationStatuses(&out, statuses)
+		t.Logf("status:\n%s", out.String())
+		if len(statuses) != 3 || !statuses[2].Unknown {
+			t.Errorf("unexpected statuses %v\n", statuses)
+		}
+		if !strings.Contains(out.String(), "refuse to start") {
+			t.Errorf("status does not warn about the newer schema\n")
+		}
+	})
+}
+
+func TestMigrationStatusesFresh(t *testing.T) {
+	dsn := "file:" + t.TempDir() + "/fresh.db"
+	db, err := OpenDB(dsn)
+	if err != nil {
+		t.Fatalf("OpenDB error: %s\n", err)
+	}
+	defer db.Close()
+
+	statuses, err := MigrationStatuses(db, MIGRATIONS)
+	if err != nil {
+		t.Fatalf("MigrationStatuses error: %s\n", err)
+	}
+	if len(statuses) != len(MIGRATIONS) || statuses[0].AppliedAt != nil {
+		t.Errorf("unexpected statuses %v\n", statuses)
+	}
+
+	var schema string
+	err = db.QueryRow(TABLE_SCHEMA_QUERY, SCHEMA_VERSION_TABLE_NAME).Scan(&schema)
+	if !IsNoRows(err) {
+		t.Errorf("status created the schema_version table\n")
+	}
+}
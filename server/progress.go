@@ -0,0 +1,201 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress of a download or transcode recognised in a command's output
+type Progress struct {
+	// name of the parser that recognised the output
+	Parser  string   `json:"parser"`
+	Percent *float64 `json:"percent"`
+	// bytes per second, or a multiple of realtime when `RateUnit` is `x`
+	Rate     *float64 `json:"rate"`
+	RateUnit string   `json:"rateUnit"`
+	EtaMs    *int64   `json:"etaMs"`
+}
+
+type ProgressParser interface {
+	// progress reported by `line`, nil if the line carries none.
+	// parsers are created per command and may remember earlier lines
+	Parse(line string) *Progress
+}
+
+// tried in order on every line of output
+var PROGRESS_PARSERS = []func() ProgressParser{
+	NewAxelProgress,
+	NewFfmpegProgress,
+}
+
+// least time between two published progress updates of a command
+const PROGRESS_INTERVAL = 250 * time.Millisecond
+
+// Runs the progress parsers over the output of one command
+type ProgressTracker struct {
+	mu        sync.Mutex
+	parsers   []ProgressParser
+	published time.Time
+}
+
+func NewProgressTracker() *ProgressTracker {
+	parsers := make([]ProgressParser, len(PROGRESS_PARSERS))
+	for i, newParser := range PROGRESS_PARSERS {
+		parsers[i] = newParser()
+	}
+	return &ProgressTracker{parsers: parsers}
+}
+
+// progress found in `line` if it is due to be published
+func (t *ProgressTracker) Track(line string) *Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, parser := range t.parsers {
+		progress := parser.Parse(line)
+		if progress == nil {
+			continue
+		}
+
+		done := progress.Percent != nil && *progress.Percent >= 100
+		if !done && time.Since(t.published) < PROGRESS_INTERVAL {
+			return nil
+		}
+		t.published = time.Now()
+		return progress
+	}
+	return nil
+}
+
+var BYTE_UNITS = map[string]float64{
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parse a size unit like `KB`, `MiB` or `B` as a multiple of bytes
+func parseByteUnit(unit string) (float64, bool) {
+	unit = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(unit), "B"), "I")
+	if len(unit) == 0 {
+		unit = "B"
+	}
+	multiple, found := BYTE_UNITS[unit]
+	return multiple, found
+}
+
+// Progress lines of axel like `[ 45%] [....] [   1.2MB/s] [02:31]`
+type AxelProgress struct{}
+
+func NewAxelProgress() ProgressParser {
+	return &AxelProgress{}
+}
+
+var axelPercentRe = regexp.MustCompile(`\[\s*(\d{1,3}(?:\.\d+)?)%\]`)
+var axelRateRe = regexp.MustCompile(`\[\s*(\d+(?:\.\d+)?)\s*([KMGT]?i?B)/s\]`)
+var axelEtaRe = regexp.MustCompile(`\[\s*(\d+):(\d{2})(?::(\d{2}))?\]`)
+
+func (p *AxelProgress) Parse(line string) *Progress {
+	match := axelPercentRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+
+	percent, _ := strconv.ParseFloat(match[1], 64)
+	progress := &Progress{Parser: "axel", Percent: &percent}
+
+	if match := axelRateRe.FindStringSubmatch(line); match != nil {
+		rate, _ := strconv.ParseFloat(match[1], 64)
+		if multiple, ok := parseByteUnit(match[2]); ok {
+			rate *= multiple
+			progress.Rate = &rate
+			progress.RateUnit = "B/s"
+		}
+	}
+
+	if match := axelEtaRe.FindStringSubmatch(line); match != nil {
+		parts := []string{match[1], match[2]}
+		if len(match[3]) > 0 {
+			parts = append(parts, match[3])
+		}
+		var seconds int64
+		for _, part := range parts {
+			n, _ := strconv.ParseInt(part, 10, 64)
+			seconds = seconds*60 + n
+		}
+		etaMs := seconds * 1000
+		progress.EtaMs = &etaMs
+	}
+
+	return progress
+}
+
+// Progress lines of ffmpeg like `frame=  100 ... time=00:00:04.00 ... speed=1.5x`.
+// the percentage and ETA need the input duration printed before them
+type FfmpegProgress struct {
+	duration time.Duration
+}
+
+func NewFfmpegProgress() ProgressParser {
+	return &FfmpegProgress{}
+}
+
+var ffmpegDurationRe = regexp.MustCompile(`Duration: (\d+:\d{2}:\d{2}(?:\.\d+)?)`)
+var ffmpegTimeRe = regexp.MustCompile(`time=\s*(-?\d+:\d{2}:\d{2}(?:\.\d+)?)`)
+var ffmpegSpeedRe = regexp.MustCompile(`speed=\s*(\d+(?:\.\d+)?)x`)
+
+// parse a `hh:mm:ss.ms` timestamp
+func parseTimestamp(ts string) time.Duration {
+	negative := strings.HasPrefix(ts, "-")
+	parts := strings.Split(strings.TrimPrefix(ts, "-"), ":")
+
+	var seconds float64
+	for _, part := range parts {
+		n, _ := strconv.ParseFloat(part, 64)
+		seconds = seconds*60 + n
+	}
+	if negative {
+		seconds = -seconds
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (p *FfmpegProgress) Parse(line string) *Progress {
+	if match := ffmpegDurationRe.FindStringSubmatch(line); match != nil {
+		// the longest input decides the length of the output
+		if duration := parseTimestamp(match[1]); duration > p.duration {
+			p.duration = duration
+		}
+		return nil
+	}
+
+	match := ffmpegTimeRe.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	position := max(parseTimestamp(match[1]), 0)
+	progress := &Progress{Parser: "ffmpeg"}
+
+	if p.duration > 0 {
+		percent := min(100*position.Seconds()/p.duration.Seconds(), 100)
+		progress.Percent = &percent
+	}
+
+	if match := ffmpegSpeedRe.FindStringSubmatch(line); match != nil {
+		speed, _ := strconv.ParseFloat(match[1], 64)
+		progress.Rate = &speed
+		progress.RateUnit = "x"
+
+		if p.duration > 0 && speed > 0 {
+			left := max(p.duration-position, 0)
+			etaMs := int64(left.Seconds() / speed * 1000)
+			progress.EtaMs = &etaMs
+		}
+	}
+
+	return progress
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAxelProgress(t *testing.T) {
+	parser := NewAxelProgress()
+
+	progress := parser.Parse("[ 45%] [....0123  ....  ] [   1.5MB/s] [02:31]")
+	if progress == nil {
+		t.Fatalf("expected progress\n")
+	}
+	if progress.Percent == nil || *progress.Percent != 45 {
+		t.Errorf("unexpected percent %v\n", progress.Percent)
+	}
+	if progress.Rate == nil || *progress.Rate != 1.5*(1<<20) || progress.RateUnit != "B/s" {
+		t.Errorf("unexpected rate %v %s\n", progress.Rate, progress.RateUnit)
+	}
+	if progress.EtaMs == nil || *progress.EtaMs != 151000 {
+		t.Errorf("unexpected eta %v\n", progress.EtaMs)
+	}
+
+	progress = parser.Parse("[  3%]  .......... .......... ..........  [ 166.7KB/s]")
+	if progress == nil || *progress.Percent != 3 || progress.EtaMs != nil {
+		t.Errorf("unexpected progress of plain axel output %+v\n", progress)
+	}
+
+	if parser.Parse("Initializing download: http://example.com/file") != nil {
+		t.Errorf("expected no progress\n")
+	}
+}
+
+func TestFfmpegProgress(t *testing.T) {
+	parser := NewFfmpegProgress()
+
+	line := "frame=  100 fps= 25 q=28.0 size=    1024KiB time=00:00:30.00 bitrate=2097.2kbits/s speed=2.0x"
+	progress := parser.Parse(line)
+	if progress == nil || progress.Percent != nil || *progress.Rate != 2 {
+		t.Fatalf("unexpected progress without duration %+v\n", progress)
+	}
+
+	if parser.Parse("  Duration: 00:02:00.00, start: 0.000000, bitrate: 5000 kb/s") != nil {
+		t.Errorf("expected no progress from the duration line\n")
+	}
+
+	progress = parser.Parse(line)
+	if progress.Percent == nil || math.Abs(*progress.Percent-25) > 0.001 {
+		t.Errorf("unexpected percent %v\n", progress.Percent)
+	}
+	if progress.RateUnit != "x" || progress.EtaMs == nil || *progress.EtaMs != 45000 {
+		t.Errorf("unexpected eta %v\n", progress.EtaMs)
+	}
+
+	progress = parser.Parse("size=       0KiB time=-00:00:00.02 bitrate=N/A speed=N/A")
+	if progress == nil || *progress.Percent != 0 || progress.Rate != nil {
+		t.Errorf("unexpected progress at start %+v\n", progress)
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	tracker := NewProgressTracker()
+
+	if tracker.Track("[ 10%] [..] [ 1.0KB/s] [00:10]") == nil {
+		t.Errorf("expected first progress to be published\n")
+	}
+	if tracker.Track("[ 11%] [..] [ 1.0KB/s] [00:09]") != nil {
+		t.Errorf("expected progress to be throttled\n")
+	}
+	if progress := tracker.Track("[100%] [..] [ 1.0KB/s] [00:00]"); progress == nil {
+		t.Errorf("expected completion to be published\n")
+	}
+}
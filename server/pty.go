@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DEFAULT_TTY_ROWS = 24
+	DEFAULT_TTY_COLS = 80
+)
+
+// Open a new pseudo terminal, returns the master and slave ends
+func OpenPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	err = ioctl(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err
+		}
+		n, err = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func SetPtySize(pty *os.File, rows uint16, cols uint16) error {
+	return ioctl(pty, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+	})
+}
+
+// run `fn` with the raw descriptor without switching the file to blocking mode
+func ioctl(f *os.File, fn func(fd int) error) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	err = conn.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// Reads the master end of a pty, reporting EOF instead of the EIO
+// linux returns once every slave descriptor is closed
+type PtyReader struct {
+	*os.File
+}
+
+func (r PtyReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	if errors.Is(err, syscall.EIO) {
+		return n, io.EOF
+	}
+	return n, err
+}
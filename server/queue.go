@@ -0,0 +1,397 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// Named queue limiting how many of its commands run at the same time
+type Queue struct {
+	Name           string `json:"name"`
+	MaxConcurrency int    `json:"maxConcurrency"`
+	// commands handed to the runner that have not finished yet,
+	// paused commands keep their slot
+	Running int `json:"running"`
+	// commands waiting for a free slot
+	Queued int `json:"queued"`
+}
+
+var ErrNotQueued = errors.New("command is not queued")
+var ErrQueueNotEmpty = errors.New("queue still has commands")
+var ErrUnknownQueue = errors.New("unknown queue")
+
+const SAVE_QUEUE_QUERY = `
+INSERT INTO queue (name, max_concurrency)
+VALUES (?, ?)
+ON CONFLICT (name) DO UPDATE SET max_concurrency = excluded.max_concurrency;
+`
+const QUEUE_COLUMNS = `
+q.name, q.max_concurrency,
+(SELECT COUNT(*) FROM command c WHERE c.queue = q.name AND c.status IN ('IDLE', 'RUNNING', 'PAUSED')),
+(SELECT COUNT(*) FROM command c WHERE c.queue = q.name AND c.status = 'QUEUED')
+`
+const SELECT_QUEUE_QUERY = `
+SELECT ` + QUEUE_COLUMNS + `
+FROM queue q
+WHERE q.name = $1;
+`
+const LIST_QUEUE_QUERY = `
+SELECT ` + QUEUE_COLUMNS + `
+FROM queue q
+ORDER BY q.name;
+`
+const DELETE_QUEUE_QUERY = `
+DELETE FROM queue
+WHERE name = $1
+AND NOT EXISTS (
+    SELECT 1 FROM command WHERE queue = $1 AND status IN ('PENDING', 'QUEUED', 'IDLE', 'RUNNING', 'PAUSED')
+);
+`
+const LIST_QUEUED_QUERY = `
+SELECT ` + COMMAND_COLUMNS + `
+FROM command
+WHERE queue = $1 AND status = 'QUEUED'
+ORDER BY queue_position, id
+LIMIT $2;
+`
+const LIST_QUEUED_ID_QUERY = `
+SELECT id
+FROM command
+WHERE queue = $1 AND status = 'QUEUED'
+ORDER BY queue_position, id;
+`
+const UPDATE_QUEUE_POSITION_QUERY = `
+UPDATE command
+SET queue_position = ?
+WHERE id = ?;
+`
+const DEQUEUE_QUERY = `
+UPDATE command
+SET status = 'IDLE'
+WHERE id = ? AND status = 'QUEUED';
+`
+const CANCEL_QUEUED_QUERY = `
+UPDATE command
+SET status = 'CANCELED', finished_at = ?
+WHERE id = ? AND status IN ('QUEUED', 'PENDING');
+`
+
+// create the queue or update its concurrency
+func (db *CockpitDB) SaveQueue(queue *Queue) error {
+	_, err := db.Exec(SAVE_QUEUE_QUERY, queue.Name, queue.MaxConcurrency)
+	if err != nil {
+		slog.Error("failed to save queue", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (db *CockpitDB) GetQueue(name string) (*Queue, error) {
+	var q Queue
+
+	row := db.QueryRow(SELECT_QUEUE_QUERY, name)
+	if err := row.Scan(&q.Name, &q.MaxConcurrency, &q.Running, &q.Queued); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (db *CockpitDB) ListQueues() ([]Queue, error) {
+	rows, err := db.Query(LIST_QUEUE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queues := []Queue{}
+	for rows.Next() {
+		var q Queue
+		err := rows.Scan(&q.Name, &q.MaxConcurrency, &q.Running, &q.Queued)
+		if err != nil {
+			slog.Error("ListQueues", "error", err)
+			continue
+		}
+
+		queues = append(queues, q)
+	}
+
+	if err = rows.Err(); err != nil {
+		return queues, err
+	}
+	return queues, nil
+}
+
+// delete the queue, fails with ErrQueueNotEmpty while it has unfinished commands
+func (db *CockpitDB) DeleteQueue(name string) error {
+	result, err := db.Exec(DELETE_QUEUE_QUERY, name)
+	if err != nil {
+		slog.Error("failed to delete queue", "error", err)
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := db.GetQueue(name); err != nil {
+			return err
+		}
+		return ErrQueueNotEmpty
+	}
+	return nil
+}
+
+// first `n` queued commands of `queue` in queue order
+func (db *CockpitDB) ListQueued(queue string, n uint) ([]Command, error) {
+	rows, err := db.Query(LIST_QUEUED_QUERY, queue, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []Command{}
+	for rows.Next() {
+		var c Command
+		err := scanCommand(rows, &c)
+		if err != nil {
+			slog.Error("ListQueued", "error", err)
+			continue
+		}
+
+		commands = append(commands, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return commands, err
+	}
+	return commands, nil
+}
+
+// move `ids` to the front of `queue` in the given order,
+// the remaining queued commands keep their relative order behind them
+func (db *CockpitDB) ReorderQueue(queue string, ids []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(LIST_QUEUED_ID_QUERY, queue)
+	if err != nil {
+		return err
+	}
+	queued := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		queued = append(queued, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	order := make([]string, 0, len(queued))
+	for _, id := range ids {
+		if !slices.Contains(queued, id) {
+			return fmt.Errorf("%w: %s", ErrNotQueued, id)
+		}
+		if !slices.Contains(order, id) {
+			order = append(order, id)
+		}
+	}
+	for _, id := range queued {
+		if !slices.Contains(order, id) {
+			order = append(order, id)
+		}
+	}
+
+	for i, id := range order {
+		if _, err := tx.Exec(UPDATE_QUEUE_POSITION_QUERY, i+1, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// take a command out of its queue to run it, it becomes IDLE
+func (db *CockpitDB) Dequeue(id string) error {
+	result, err := db.Exec(DEQUEUE_QUERY, id)
+	if err != nil {
+		slog.Error("failed to dequeue command", "error", err)
+		return err
+	}
+	return expectAffected(result, ErrNotQueued)
+}
+
+// cancel a command that is still waiting in its queue or for its dependencies
+func (db *CockpitDB) CancelQueued(id string) error {
+	result, err := db.Exec(CANCEL_QUEUED_QUERY, FormatNow(), id)
+	if err != nil {
+		slog.Error("failed to cancel queued command", "error", err)
+		return err
+	}
+	return expectAffected(result, ErrNotQueued)
+}
+
+// return `notFound` if the statement did not change any row
+func expectAffected(result sql.Result, notFound error) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// Starts queued commands whenever their queue has a free slot
+type Dispatcher struct {
+	DB     DB
+	Runner Runner
+	Bus    *EventBus
+	kick   chan struct{}
+	// serializes advancing workflows
+	workflowMu sync.Mutex
+}
+
+func NewDispatcher(db DB, runner Runner, bus *EventBus) *Dispatcher {
+	return &Dispatcher{
+		DB:     db,
+		Runner: runner,
+		Bus:    bus,
+		kick:   make(chan struct{}, 1),
+	}
+}
+
+// dispatch on startup and after every finished command, blocks forever
+func (d *Dispatcher) Start() error {
+	_, err := Sub(d.Bus, "command", func(evt any) {
+		msg, ok := evt.(*CommandEvent)
+		if ok && msg.Type == COMMAND_UPDATE && msg.Status.IsFinished() {
+			d.Kick()
+			// runs outside the callback since it publishes on the same topic
+			go d.Retry(msg.Id)
+			go d.AdvanceNode(msg.Id)
+		}
+	})
+	if err != nil {
+		slog.Error("Dispatcher.Start", "error", err)
+		return err
+	}
+
+	d.ResumeRetries()
+	d.AdvanceWorkflows()
+	d.Kick()
+	for range d.kick {
+		d.Dispatch()
+	}
+	return nil
+}
+
+// Insert a new command and start it, or leave it to the dispatcher when it
+// targets a queue. The inserted command is returned even if the runner fails.
+func (d *Dispatcher) Submit(command *Command) (*Command, error) {
+	if err := d.checkQueue(command.Queue); err != nil {
+		return nil, err
+	}
+
+	command, err := d.DB.NewCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := CommandMessage(command, COMMAND_CREATE)
+	if err := Pub[any](d.Bus, "command", msg); err != nil {
+		slog.Error("failed to send create command message", "message", msg, "error", err)
+	}
+
+	if command.Status == COMMAND_QUEUED {
+		d.Kick()
+		return command, nil
+	}
+
+	// a command that cannot start is marked ERROR by the runner, which
+	// retries and workflows wait for like any other finished status
+	if err := d.Runner.Run(d.DB, command); err != nil {
+		command.Status = COMMAND_ERROR
+		return command, err
+	}
+	return command, nil
+}
+
+// fails with ErrUnknownQueue unless `queue` is empty or exists
+func (d *Dispatcher) checkQueue(queue string) error {
+	if len(queue) == 0 {
+		return nil
+	}
+	_, err := d.DB.GetQueue(queue)
+	if IsNoRows(err) {
+		return fmt.Errorf("%w %s", ErrUnknownQueue, queue)
+	}
+	return err
+}
+
+// request a dispatch pass without blocking the caller
+func (d *Dispatcher) Kick() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) Dispatch() {
+	queues, err := d.DB.ListQueues()
+	if err != nil {
+		slog.Error("Dispatcher.Dispatch db.ListQueues", "error", err)
+		return
+	}
+
+	for _, queue := range queues {
+		free := queue.MaxConcurrency - queue.Running
+		if free <= 0 || queue.Queued == 0 {
+			continue
+		}
+
+		commands, err := d.DB.ListQueued(queue.Name, uint(free))
+		if err != nil {
+			slog.Error("Dispatcher.Dispatch db.ListQueued", "queue", queue.Name, "error", err)
+			continue
+		}
+		for i := range commands {
+			d.start(&commands[i])
+		}
+	}
+}
+
+func (d *Dispatcher) start(command *Command) {
+	// IDLE keeps the slot taken until the runner marks it RUNNING,
+	// fails if the command was canceled in the meantime
+	if err := d.DB.Dequeue(command.Id); err != nil {
+		return
+	}
+	command.Status = COMMAND_IDLE
+	msg := CommandMessage(&Command{Id: command.Id, Status: COMMAND_IDLE}, COMMAND_UPDATE)
+	if err := Pub[any](d.Bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+
+	d.run(command, "queued command")
+}
+
+// run an IDLE command, marking it as ERROR if the runner fails to start it
+// the runner marks the command ERROR if it cannot be started
+func (d *Dispatcher) run(command *Command, kind string) {
+	if err := d.Runner.Run(d.DB, command); err != nil {
+		slog.Error("Dispatcher.run runner.Run", "id", command.Id, "kind", kind, "error", err)
+	}
+}
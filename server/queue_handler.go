@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SaveQueue struct {
+	Name           string `json:"name"`
+	MaxConcurrency int    `json:"maxConcurrency"`
+}
+
+func SaveQueueHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	saveQueue := new(SaveQueue)
+	if err := cc.Bind(saveQueue); err != nil {
+		slog.Error("SaveQueueHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	if len(saveQueue.Name) == 0 {
+		return cc.String(http.StatusBadRequest, "empty queue name")
+	}
+	if saveQueue.MaxConcurrency <= 0 {
+		return cc.String(http.StatusBadRequest, "maxConcurrency must be positive")
+	}
+
+	queue := &Queue{Name: saveQueue.Name, MaxConcurrency: saveQueue.MaxConcurrency}
+	if err := cc.DB.SaveQueue(queue); err != nil {
+		slog.Error("SaveQueueHandler cc.DB.SaveQueue", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	// a raised limit may free slots
+	cc.Dispatcher.Kick()
+
+	queue, err := cc.DB.GetQueue(queue.Name)
+	if err != nil {
+		slog.Error("SaveQueueHandler cc.DB.GetQueue", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusCreated, queue)
+}
+
+func ListQueueHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	queues, err := cc.DB.ListQueues()
+	if err != nil {
+		slog.Error("ListQueueHandler cc.DB.ListQueues", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, queues)
+}
+
+type QueueInfo struct {
+	*Queue
+	// queued commands in the order they will run
+	Commands []Command `json:"commands"`
+}
+
+func GetQueueHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	name := cc.Param("name")
+	queue, err := cc.DB.GetQueue(name)
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "queue not found")
+	} else if err != nil {
+		slog.Error("GetQueueHandler cc.DB.GetQueue", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	commands, err := cc.DB.ListQueued(name, uint(queue.Queued))
+	if err != nil {
+		slog.Error("GetQueueHandler cc.DB.ListQueued", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, QueueInfo{Queue: queue, Commands: commands})
+}
+
+type ReorderQueue struct {
+	// queued command ids to move to the front, in order
+	Commands []string `json:"commands"`
+}
+
+func ReorderQueueHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	reorderQueue := new(ReorderQueue)
+	if err := cc.Bind(reorderQueue); err != nil {
+		slog.Error("ReorderQueueHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	name := cc.Param("name")
+	err := cc.DB.ReorderQueue(name, reorderQueue.Commands)
+	if errors.Is(err, ErrNotQueued) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		slog.Error("ReorderQueueHandler cc.DB.ReorderQueue", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	commands, err := cc.DB.ListQueued(name, uint(len(reorderQueue.Commands)))
+	if err != nil {
+		slog.Error("ReorderQueueHandler cc.DB.ListQueued", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	for _, command := range commands {
+		msg := CommandMessage(&Command{
+			Id:            command.Id,
+			Status:        command.Status,
+			QueuePosition: command.QueuePosition,
+		}, COMMAND_UPDATE)
+		Pub[any](cc.Bus, "command", msg)
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
+func DeleteQueueHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	err := cc.DB.DeleteQueue(cc.Param("name"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "queue not found")
+	} else if errors.Is(err, ErrQueueNotEmpty) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		slog.Error("DeleteQueueHandler cc.DB.DeleteQueue", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.NoContent(http.StatusOK)
+}
+
+func CancelCommandHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	id := cc.Param("id")
+	err := cc.DB.CancelQueued(id)
+	if errors.Is(err, ErrNotQueued) {
+		return cc.String(http.StatusBadRequest, "command is not queued")
+	} else if err != nil {
+		slog.Error("CancelCommandHandler cc.DB.CancelQueued", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	msg := CommandMessage(&Command{Id: id, Status: COMMAND_CANCELED}, COMMAND_UPDATE)
+	Pub[any](cc.Bus, "command", msg)
+
+	return cc.NoContent(http.StatusOK)
+}
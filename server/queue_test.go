@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// a command that cannot be started does not stay IDLE
+func TestSubmitRunFailure(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+	updates := make(chan *CommandEvent, 10)
+	Sub(bus, "command", func(msg any) {
+		if event, ok := msg.(*CommandEvent); ok && event.Type == COMMAND_UPDATE {
+			updates <- event
+		}
+	})
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	dispatcher := NewDispatcher(db, runner, bus)
+
+	// the script cannot be written
+	t.Setenv("TMPDIR", t.TempDir()+"/missing")
+	command, err := dispatcher.Submit(&Command{Command: "echo hi", Exec: &ExecSpec{Mode: EXEC_SCRIPT}})
+	if err == nil || command == nil {
+		t.Fatalf("expected Submit to fail running the command, got %+v %v\n", command, err)
+	}
+
+	failed, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if failed.Status != COMMAND_ERROR || failed.FinishedAt == nil {
+		t.Errorf("expected the command to be marked ERROR, got %+v\n", failed)
+	}
+	select {
+	case event := <-updates:
+		if event.Id != command.Id || event.Status != COMMAND_ERROR {
+			t.Errorf("unexpected update %+v\n", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no update published\n")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reconcile commands left IDLE, RUNNING or PAUSED by a previous server process.
+// Process groups that are still alive are adopted by the runner,
+// every other command is marked as LOST.
+func RecoverCommands(db DB, runner Runner, bus *EventBus) error {
+	commands, err := db.ListCommandsByStatus(COMMAND_IDLE, COMMAND_RUNNING, COMMAND_PAUSED)
+	if err != nil {
+		slog.Error("RecoverCommands db.ListCommandsByStatus", "error", err)
+		return err
+	}
+
+	for i := range commands {
+		command := &commands[i]
+		if command.Status != COMMAND_IDLE && ProcessAlive(command) {
+			err := runner.Adopt(db, command)
+			if err == nil {
+				slog.Info("adopted running command", "id", command.Id, "pgid", *command.Pgid)
+				continue
+			}
+			slog.Error("RecoverCommands runner.Adopt", "id", command.Id, "error", err)
+		}
+
+		MarkLost(db, bus, command)
+	}
+	return nil
+}
+
+func MarkLost(db DB, bus *EventBus, command *Command) {
+	finishedAt := FormatNow()
+	result := &Command{Id: command.Id, Status: COMMAND_LOST, FinishedAt: &finishedAt}
+	db.UpdateFinished(result)
+	AddErrorLog(db, command.Id, fmt.Sprintf(
+		"server restarted while command was %s, marked as %s", command.Status, COMMAND_LOST,
+	))
+
+	msg := CommandMessage(result, COMMAND_UPDATE)
+	if err := Pub[any](bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+}
+
+// max difference between the recorded start time and the process start time,
+// anything further apart is a different process that reused the pid
+const PROCESS_START_TOLERANCE = 5 * time.Second
+
+// whether the process recorded on `command` is still alive,
+// checked against its process group and start time to rule out pid reuse
+func ProcessAlive(command *Command) bool {
+	if command.Pid == nil || command.Pgid == nil || command.StartedAt == nil {
+		return false
+	}
+
+	startedAt, err := time.Parse(time.RFC3339Nano, *command.StartedAt)
+	if err != nil {
+		return false
+	}
+
+	pgrp, procStart, err := ProcStat(*command.Pid)
+	if err != nil {
+		return false
+	}
+	if pgrp != *command.Pgid {
+		return false
+	}
+
+	diff := startedAt.Sub(procStart)
+	return diff > -PROCESS_START_TOLERANCE && diff < PROCESS_START_TOLERANCE
+}
+
+// kernel clock ticks per second, USER_HZ is 100 on all supported platforms
+const CLOCK_TICKS = 100
+
+// fields of /proc/<pid>/stat after the command name, so fields[0] is
+// `state` (field 3 in proc(5)) and field N is fields[N-3]
+func procStatFields(pid int) ([]string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// the command name may contain spaces, fields start after its closing paren
+	stat := string(data)
+	idx := strings.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return fields, nil
+}
+
+// process group and start time of `pid` read from /proc
+func ProcStat(pid int) (int, time.Time, error) {
+	fields, err := procStatFields(pid)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// pgrp is field 5 and starttime is field 22
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	bootTime, err := BootTime()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	start := bootTime.Add(time.Duration(ticks) * time.Second / CLOCK_TICKS)
+	return pgrp, start, nil
+}
+
+func BootTime() (time.Time, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, found := strings.CutPrefix(line, "btime "); found {
+			btime, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("btime not found in /proc/stat")
+}
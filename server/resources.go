@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often the process group of a running command is sampled
+const RESOURCE_SAMPLE_INTERVAL = 5 * time.Second
+
+// Resource usage of a command's process group at one point in time
+type ResourceSample struct {
+	Id        string `json:"id"`
+	CommandId string `json:"commandId"`
+	CreatedAt string `json:"createdAt"`
+	// cpu time used since the previous sample, 100 per fully used core
+	CpuPercent float64 `json:"cpuPercent"`
+	RssBytes   int64   `json:"rssBytes"`
+	// bytes read from and written to storage by the processes alive at the sample
+	ReadBytes  int64 `json:"readBytes"`
+	WriteBytes int64 `json:"writeBytes"`
+	Threads    int   `json:"threads"`
+	Processes  int   `json:"processes"`
+}
+
+const RESOURCE_SAMPLE_COLUMNS = `
+id, command_id, created_at, cpu_percent, rss_bytes, read_bytes, write_bytes, threads, processes
+`
+const INSERT_RESOURCE_SAMPLE_QUERY = `
+INSERT INTO resource_sample (
+    id, command_id, created_at, cpu_percent, rss_bytes,
+    read_bytes, write_bytes, threads, processes
+)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+const SELECT_RESOURCE_SAMPLE_QUERY = `
+SELECT id, command_id, created_at, cpu_percent, rss_bytes,
+       read_bytes, write_bytes, threads, processes
+FROM resource_sample
+WHERE command_id = $1
+ORDER BY id;
+`
+
+func (db *CockpitDB) AddResourceSample(sample *ResourceSample) error {
+	_, err := db.Exec(
+		INSERT_RESOURCE_SAMPLE_QUERY,
+		sample.Id,
+		sample.CommandId,
+		sample.CreatedAt,
+		sample.CpuPercent,
+		sample.RssBytes,
+		sample.ReadBytes,
+		sample.WriteBytes,
+		sample.Threads,
+		sample.Processes,
+	)
+	if err != nil {
+		slog.Error("failed to insert resource sample", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (db *CockpitDB) GetResourceSamples(commandId string) ([]ResourceSample, error) {
+	rows, err := db.Query(SELECT_RESOURCE_SAMPLE_QUERY, commandId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []ResourceSample{}
+	for rows.Next() {
+		var s ResourceSample
+		err := rows.Scan(
+			&s.Id, &s.CommandId, &s.CreatedAt, &s.CpuPercent, &s.RssBytes,
+			&s.ReadBytes, &s.WriteBytes, &s.Threads, &s.Processes,
+		)
+		if err != nil {
+			slog.Error("GetResourceSamples", "error", err)
+			continue
+		}
+
+		samples = append(samples, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return samples, err
+	}
+	return samples, nil
+}
+
+// name of the topic live samples of a command are published on
+func ResourceTopic(commandId string) string {
+	return commandId + "/resources"
+}
+
+// Usage summed over every process of a process group
+type GroupUsage struct {
+	// user and system time in clock ticks, including reaped children
+	CpuTicks   int64
+	RssBytes   int64
+	ReadBytes  int64
+	WriteBytes int64
+	Threads    int
+	Processes  int
+}
+
+// usage of the process group `pgid` read from /proc
+func ProcGroupUsage(pgid int) (*GroupUsage, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pageSize := int64(os.Getpagesize())
+	usage := &GroupUsage{}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// processes may exit while they are read
+		fields, err := procStatFields(pid)
+		if err != nil {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(fields[2]); pgrp != pgid {
+			continue
+		}
+
+		// utime, stime, cutime and cstime are fields 14 to 17
+		for _, field := range fields[11:15] {
+			ticks, _ := strconv.ParseInt(field, 10, 64)
+			usage.CpuTicks += ticks
+		}
+		threads, _ := strconv.Atoi(fields[17])
+		rss, _ := strconv.ParseInt(fields[21], 10, 64)
+		usage.Threads += threads
+		usage.RssBytes += rss * pageSize
+		usage.Processes++
+
+		readBytes, writeBytes := procIO(pid)
+		usage.ReadBytes += readBytes
+		usage.WriteBytes += writeBytes
+	}
+
+	if usage.Processes == 0 {
+		return nil, fmt.Errorf("process group %d has no processes", pgid)
+	}
+	return usage, nil
+}
+
+// storage bytes read and written by `pid`, zero if /proc/<pid>/io is not readable
+func procIO(pid int) (int64, int64) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	var readBytes, writeBytes int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ": ")
+		n, _ := strconv.ParseInt(value, 10, 64)
+		switch key {
+		case "read_bytes":
+			readBytes = n
+		case "write_bytes":
+			writeBytes = n
+		}
+	}
+	return readBytes, writeBytes
+}
+
+// sample the process group every `interval` until the session is done,
+// keeping the peak rss for the finished command
+func (s *Session) Sampler(db DB, bus *EventBus, interval time.Duration) {
+	pgid := int(s.pgid.Load())
+	prev, err := ProcGroupUsage(pgid)
+	if err != nil {
+		return
+	}
+	s.peakRss.Store(prev.RssBytes)
+	prevTime := time.Now()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			usage, err := ProcGroupUsage(pgid)
+			if err != nil {
+				continue
+			}
+
+			cpuSeconds := float64(usage.CpuTicks-prev.CpuTicks) / CLOCK_TICKS
+			sample := &ResourceSample{
+				Id:         IdGen(),
+				CommandId:  s.Id,
+				CreatedAt:  FormatNow(),
+				CpuPercent: max(cpuSeconds/now.Sub(prevTime).Seconds()*100, 0),
+				RssBytes:   usage.RssBytes,
+				ReadBytes:  usage.ReadBytes,
+				WriteBytes: usage.WriteBytes,
+				Threads:    usage.Threads,
+				Processes:  usage.Processes,
+			}
+			prev, prevTime = usage, now
+			if usage.RssBytes > s.peakRss.Load() {
+				s.peakRss.Store(usage.RssBytes)
+			}
+
+			db.AddResourceSample(sample)
+			if err := Pub(bus, ResourceTopic(s.Id), sample); err != nil {
+				slog.Error("Session.Sampler", "error", err)
+			}
+		}
+	}
+}
+
+// peak rss seen by the sampler, nil if the group was never sampled
+func (s *Session) SampledPeakRss() *int64 {
+	peak := s.peakRss.Load()
+	if peak == 0 {
+		return nil
+	}
+	return &peak
+}
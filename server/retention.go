@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// how often the janitor applies the retention policy
+const RETENTION_INTERVAL = 10 * time.Minute
+
+// commands that finished more recently are never pruned, their retry or
+// workflow may still be looking at them
+const RETENTION_GRACE = 1 * time.Minute
+
+// logs deleted per transaction, so the log writer never waits long for
+// the database while a large backlog is pruned
+const RETENTION_BATCH = 500
+
+// Which finished commands and logs are kept, every rule is off while nil.
+// Pinned commands and nodes of running workflows are never pruned.
+type RetentionPolicy struct {
+	// finished commands older than this are deleted with their logs
+	MaxAgeDays *int `json:"maxAgeDays"`
+	// newest log lines kept per finished command
+	MaxLogLines *int `json:"maxLogLines"`
+	// newest log bytes kept per finished command, lines are kept whole
+	MaxLogBytes *int64 `json:"maxLogBytes"`
+	// newest finished commands kept, older ones are deleted with their logs
+	KeepFinished *int `json:"keepFinished"`
+}
+
+// What one run of the retention policy reclaimed
+type RetentionReport struct {
+	StartedAt  string `json:"startedAt"`
+	DurationMs int64  `json:"durationMs"`
+	// commands deleted with their logs
+	DeletedCommands int `json:"deletedCommands"`
+	// commands that lost their oldest log lines
+	TrimmedCommands int   `json:"trimmedCommands"`
+	DeletedLogs     int64 `json:"deletedLogs"`
+	// size of the deleted log contents, the database file only
+	// shrinks after a vacuum
+	DeletedBytes int64 `json:"deletedBytes"`
+}
+
+func migrateRetention(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE command ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE retention_policy (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    max_age_days INTEGER,
+    max_log_lines INTEGER,
+    max_log_bytes INTEGER,
+    keep_finished INTEGER
+);
+`)
+	return err
+}
+
+const PIN_COMMAND_QUERY = `
+UPDATE command
+SET pinned = ?
+WHERE id = ?;
+`
+const SELECT_RETENTION_POLICY_QUERY = `
+SELECT max_age_days, max_log_lines, max_log_bytes, keep_finished
+FROM retention_policy
+WHERE id = 1;
+`
+const SAVE_RETENTION_POLICY_QUERY = `
+INSERT INTO retention_policy (id, max_age_days, max_log_lines, max_log_bytes, keep_finished)
+VALUES (1, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET
+    max_age_days = excluded.max_age_days,
+    max_log_lines = excluded.max_log_lines,
+    max_log_bytes = excluded.max_log_bytes,
+    keep_finished = excluded.keep_finished;
+`
+
+// commands the retention policy may prune, $1 is the end of the grace period
+const PRUNABLE_COMMAND_CONDITION = `
+c.status IN ('EXITED', 'ERROR', 'TIMED_OUT', 'LOST', 'CANCELED', 'SKIPPED')
+AND c.pinned = 0
+AND COALESCE(c.finished_at, c.created_at) < $1
+AND (c.workflow_id IS NULL OR c.workflow_id NOT IN (SELECT id FROM workflow WHERE status = 'RUNNING'))
+`
+const EXPIRED_COMMAND_QUERY = `
+SELECT c.id
+FROM command c
+WHERE ` + PRUNABLE_COMMAND_CONDITION + `
+AND COALESCE(c.finished_at, c.created_at) < $2;
+`
+const EXCESS_COMMAND_QUERY = `
+SELECT c.id
+FROM command c
+WHERE ` + PRUNABLE_COMMAND_CONDITION + `
+ORDER BY c.id DESC
+LIMIT -1 OFFSET $2;
+`
+
+// finished commands with more log lines than $2 or more log bytes than $3
+const TRIM_COMMAND_QUERY = `
+SELECT c.id
+FROM command c
+JOIN log l ON l.command_id = c.id
+WHERE ` + PRUNABLE_COMMAND_CONDITION + `
+GROUP BY c.id
+HAVING ($2 IS NOT NULL AND COUNT(*) > $2)
+OR ($3 IS NOT NULL AND SUM(length(CAST(l.content AS BLOB))) > $3);
+`
+
+// newest log of command $1 that is past its newest $2 lines
+const LOG_LINES_CUTOFF_QUERY = `
+SELECT id
+FROM log
+WHERE command_id = $1
+ORDER BY id DESC
+LIMIT 1 OFFSET $2;
+`
+
+// newest log of command $1 that is past its newest $2 bytes
+const LOG_BYTES_CUTOFF_QUERY = `
+SELECT id FROM (
+    SELECT id, SUM(length(CAST(content AS BLOB))) OVER (ORDER BY id DESC) AS size
+    FROM log
+    WHERE command_id = $1
+)
+WHERE size > $2
+ORDER BY id DESC
+LIMIT 1;
+`
+
+// delete up to $4 logs of command $2 up to id $3, unless the command was
+// pinned or restarted in the meantime
+const DELETE_LOG_BATCH_QUERY = `
+DELETE FROM log
+WHERE id IN (
+    SELECT l.id
+    FROM log l
+    JOIN command c ON c.id = l.command_id
+    WHERE l.command_id = $2 AND l.id <= $3
+    AND ` + PRUNABLE_COMMAND_CONDITION + `
+    LIMIT $4
+)
+RETURNING length(CAST(content AS BLOB));
+`
+const DELETE_PRUNABLE_COMMAND_QUERY = `
+DELETE FROM command AS c
+WHERE c.id = $2
+AND ` + PRUNABLE_COMMAND_CONDITION + `;
+`
+
+func (db *CockpitDB) PinCommand(id string, pinned bool) error {
+	result, err := db.Exec(PIN_COMMAND_QUERY, pinned, id)
+	if err != nil {
+		slog.Error("failed to pin command", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+// the saved policy, a policy without rules if none was saved
+func (db *CockpitDB) GetRetentionPolicy() (*RetentionPolicy, error) {
+	var p RetentionPolicy
+	err := db.QueryRow(SELECT_RETENTION_POLICY_QUERY).Scan(
+		&p.MaxAgeDays, &p.MaxLogLines, &p.MaxLogBytes, &p.KeepFinished,
+	)
+	if IsNoRows(err) {
+		return &p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (db *CockpitDB) SaveRetentionPolicy(policy *RetentionPolicy) error {
+	_, err := db.Exec(
+		SAVE_RETENTION_POLICY_QUERY,
+		policy.MaxAgeDays, policy.MaxLogLines, policy.MaxLogBytes, policy.KeepFinished,
+	)
+	if err != nil {
+		slog.Error("failed to save retention policy", "error", err)
+		return err
+	}
+	return nil
+}
+
+// Commands to prune are collected first, then their logs are deleted in
+// batches of RETENTION_BATCH, each in a transaction of its own
+func (db *CockpitDB) ApplyRetention(policy *RetentionPolicy, now time.Time) (*RetentionReport, []string, error) {
+	report := &RetentionReport{StartedAt: now.UTC().Format(time.RFC3339Nano)}
+	started := time.Now()
+	grace := now.Add(-RETENTION_GRACE).UTC().Format(time.RFC3339Nano)
+
+	expired := []string{}
+	seen := map[string]bool{}
+	collect := func(query string, args ...any) ([]string, error) {
+		rows, err := db.Query(query, append([]any{grace}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		ids := []string{}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, rows.Err()
+	}
+	if policy.MaxAgeDays != nil {
+		cutoff := now.AddDate(0, 0, -*policy.MaxAgeDays).UTC().Format(time.RFC3339Nano)
+		ids, err := collect(EXPIRED_COMMAND_QUERY, cutoff)
+		if err != nil {
+			return nil, nil, err
+		}
+		expired = append(expired, ids...)
+	}
+	if policy.KeepFinished != nil {
+		ids, err := collect(EXCESS_COMMAND_QUERY, *policy.KeepFinished)
+		if err != nil {
+			return nil, nil, err
+		}
+		expired = append(expired, ids...)
+	}
+
+	deleted := []string{}
+	for _, id := range expired {
+		if _, err := db.deleteLogs(report, grace, id, MAX_ID); err != nil {
+			return nil, nil, err
+		}
+		// resource samples go with it
+		result, err := db.Exec(DELETE_PRUNABLE_COMMAND_QUERY, grace, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			deleted = append(deleted, id)
+		}
+	}
+	report.DeletedCommands = len(deleted)
+
+	// cutoff query of each rule with its limit
+	cutoffs := map[string]any{}
+	if policy.MaxLogLines != nil {
+		cutoffs[LOG_LINES_CUTOFF_QUERY] = *policy.MaxLogLines
+	}
+	if policy.MaxLogBytes != nil {
+		cutoffs[LOG_BYTES_CUTOFF_QUERY] = *policy.MaxLogBytes
+	}
+	trimmed := []string{}
+	if len(cutoffs) > 0 {
+		var err error
+		trimmed, err = collect(TRIM_COMMAND_QUERY, policy.MaxLogLines, policy.MaxLogBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, id := range trimmed {
+		// the stricter rule wins
+		cutoff := ""
+		for query, limit := range cutoffs {
+			var logId string
+			err := db.QueryRow(query, id, limit).Scan(&logId)
+			if err != nil && !IsNoRows(err) {
+				return nil, nil, err
+			}
+			cutoff = max(cutoff, logId)
+		}
+		if len(cutoff) == 0 {
+			continue
+		}
+
+		logs, err := db.deleteLogs(report, grace, id, cutoff)
+		if err != nil {
+			return nil, nil, err
+		}
+		if logs > 0 {
+			report.TrimmedCommands++
+		}
+	}
+
+	report.DurationMs = time.Since(started).Milliseconds()
+	return report, deleted, nil
+}
+
+// delete the logs of a prunable command up to id `cutoff` in batches,
+// returns how many were deleted
+func (db *CockpitDB) deleteLogs(report *RetentionReport, grace string, commandId string, cutoff string) (int64, error) {
+	var total int64
+	for {
+		logs, bytes, err := db.deleteLogBatch(grace, commandId, cutoff)
+		if err != nil {
+			return total, err
+		}
+		total += logs
+		report.DeletedLogs += logs
+		report.DeletedBytes += bytes
+		if logs < RETENTION_BATCH {
+			return total, nil
+		}
+	}
+}
+
+func (db *CockpitDB) deleteLogBatch(grace string, commandId string, cutoff string) (int64, int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(DELETE_LOG_BATCH_QUERY, grace, commandId, cutoff, RETENTION_BATCH)
+	if err != nil {
+		return 0, 0, err
+	}
+	var logs, bytes int64
+	for rows.Next() {
+		var size int64
+		if err := rows.Scan(&size); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		logs++
+		bytes += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return logs, bytes, tx.Commit()
+}
+
+// Applies the retention policy every RETENTION_INTERVAL
+type Janitor struct {
+	DB  DB
+	Bus *EventBus
+
+	// one run at a time
+	mu   sync.Mutex
+	last *RetentionReport
+	kick chan struct{}
+}
+
+func NewJanitor(db DB, bus *EventBus) *Janitor {
+	return &Janitor{
+		DB:   db,
+		Bus:  bus,
+		kick: make(chan struct{}, 1),
+	}
+}
+
+func (j *Janitor) Start() {
+	for {
+		if _, err := j.Run(time.Now()); err != nil {
+			slog.Error("Janitor.Run", "error", err)
+		}
+
+		timer := time.NewTimer(RETENTION_INTERVAL)
+		select {
+		case <-timer.C:
+		case <-j.kick:
+			timer.Stop()
+		}
+	}
+}
+
+// run the janitor right away after the policy changed
+func (j *Janitor) Kick() {
+	select {
+	case j.kick <- struct{}{}:
+	default:
+	}
+}
+
+// apply the saved policy at `now` and announce the deleted commands
+func (j *Janitor) Run(now time.Time) (*RetentionReport, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	policy, err := j.DB.GetRetentionPolicy()
+	if err != nil {
+		return nil, err
+	}
+	report, deleted, err := j.DB.ApplyRetention(policy, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range deleted {
+		Pub[any](j.Bus, "command", CommandMessage(&Command{Id: id}, COMMAND_DELETE))
+	}
+
+	if report.DeletedLogs > 0 || report.DeletedCommands > 0 {
+		slog.Info(
+			"retention policy applied",
+			"deleted commands", report.DeletedCommands,
+			"trimmed commands", report.TrimmedCommands,
+			"deleted logs", report.DeletedLogs,
+			"deleted bytes", report.DeletedBytes,
+		)
+	}
+	j.last = report
+	return report, nil
+}
+
+// report of the latest run, nil before the first one
+func (j *Janitor) LastReport() *RetentionReport {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.last
+}
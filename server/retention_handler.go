@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type RetentionInfo struct {
+	Policy *RetentionPolicy `json:"policy"`
+	// latest run of the janitor since the server started
+	LastReport *RetentionReport `json:"lastReport"`
+}
+
+func GetRetentionHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	policy, err := cc.DB.GetRetentionPolicy()
+	if err != nil {
+		slog.Error("GetRetentionHandler cc.DB.GetRetentionPolicy", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, RetentionInfo{Policy: policy, LastReport: cc.Janitor.LastReport()})
+}
+
+func SaveRetentionHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	policy := new(RetentionPolicy)
+	if err := cc.Bind(policy); err != nil {
+		slog.Error("SaveRetentionHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	if policy.MaxAgeDays != nil && *policy.MaxAgeDays <= 0 {
+		return cc.String(http.StatusBadRequest, "maxAgeDays must be positive")
+	}
+	if policy.MaxLogLines != nil && *policy.MaxLogLines <= 0 {
+		return cc.String(http.StatusBadRequest, "maxLogLines must be positive")
+	}
+	if policy.MaxLogBytes != nil && *policy.MaxLogBytes <= 0 {
+		return cc.String(http.StatusBadRequest, "maxLogBytes must be positive")
+	}
+	if policy.KeepFinished != nil && *policy.KeepFinished < 0 {
+		return cc.String(http.StatusBadRequest, "negative keepFinished")
+	}
+
+	if err := cc.DB.SaveRetentionPolicy(policy); err != nil {
+		slog.Error("SaveRetentionHandler cc.DB.SaveRetentionPolicy", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	cc.Janitor.Kick()
+
+	return cc.JSON(http.StatusOK, policy)
+}
+
+// apply the retention policy now instead of waiting for the janitor
+func RunRetentionHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	report, err := cc.Janitor.Run(time.Now())
+	if err != nil {
+		slog.Error("RunRetentionHandler cc.Janitor.Run", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, report)
+}
+
+func PinCommandHandler(c echo.Context) error {
+	return pinCommand(c, true)
+}
+
+func UnpinCommandHandler(c echo.Context) error {
+	return pinCommand(c, false)
+}
+
+func pinCommand(c echo.Context, pinned bool) error {
+	cc := c.(*CockpitContext)
+	id := cc.Param("id")
+
+	err := cc.DB.PinCommand(id, pinned)
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "command not found")
+	} else if err != nil {
+		slog.Error("pinCommand cc.DB.PinCommand", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	command, err := cc.DB.GetCommand(id)
+	if err != nil {
+		slog.Error("pinCommand cc.DB.GetCommand", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	Pub[any](cc.Bus, "command", CommandMessage(command, COMMAND_UPDATE))
+
+	return cc.JSON(http.StatusOK, command)
+}
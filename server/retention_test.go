@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	dsn := "file:" + t.TempDir() + "/retention.db"
+	db, err := NewDB(dsn, NewEventBus())
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	cockpitDB := db.(*CockpitDB)
+	defer cockpitDB.Close()
+
+	now := time.Now()
+	// a command finished `age` ago with `lines` logs of 10 bytes
+	finished := func(age time.Duration, lines int) string {
+		command, err := db.NewCommand(&Command{Command: "echo"})
+		if err != nil {
+			t.Fatalf("NewCommand error: %s\n", err)
+		}
+		finishedAt := now.Add(-age).UTC().Format(time.RFC3339Nano)
+		_, err = cockpitDB.Exec("UPDATE command SET status = 'EXITED', finished_at = ? WHERE id = ?", finishedAt, command.Id)
+		if err != nil {
+			t.Fatalf("update command error: %s\n", err)
+		}
+		for i := range lines {
+			log := &Log{Id: IdGen(), CommandId: command.Id, CreatedAt: finishedAt, Content: fmt.Sprintf("line %5d", i), FD: LOG_STDOUT}
+			if err := db.AddLog(log); err != nil {
+				t.Fatalf("AddLog error: %s\n", err)
+			}
+		}
+		return command.Id
+	}
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	exists := func(id string) bool {
+		_, err := db.GetCommand(id)
+		return err == nil
+	}
+
+	// more logs than fit in one batch
+	old := finished(days(10), RETENTION_BATCH+3)
+	pinned := finished(days(10), 3)
+	if err := db.PinCommand(pinned, true); err != nil {
+		t.Fatalf("PinCommand error: %s\n", err)
+	}
+	older := finished(2*time.Hour, 5)
+	newer := finished(1*time.Hour, 4)
+	fresh := finished(10*time.Second, 4)
+	running, err := db.NewCommand(&Command{Command: "sleep 100"})
+	if err != nil {
+		t.Fatalf("NewCommand error: %s\n", err)
+	}
+
+	t.Run("max age", func(t *testing.T) {
+		maxAgeDays := 7
+		report, deleted, err := db.ApplyRetention(&RetentionPolicy{MaxAgeDays: &maxAgeDays}, now)
+		if err != nil {
+			t.Fatalf("ApplyRetention error: %s\n", err)
+		}
+		t.Logf("report: %+v\n", report)
+		if !slices.Equal(deleted, []string{old}) {
+			t.Errorf("expected %s deleted, got %v\n", old, deleted)
+		}
+		if report.DeletedLogs != RETENTION_BATCH+3 || report.DeletedBytes != 10*(RETENTION_BATCH+3) {
+			t.Errorf("unexpected report %+v\n", report)
+		}
+		if exists(old) || !exists(pinned) {
+			t.Errorf("pinned command was pruned or old one kept\n")
+		}
+	})
+
+	t.Run("keep finished", func(t *testing.T) {
+		keepFinished := 1
+		_, deleted, err := db.ApplyRetention(&RetentionPolicy{KeepFinished: &keepFinished}, now)
+		if err != nil {
+			t.Fatalf("ApplyRetention error: %s\n", err)
+		}
+		if !slices.Equal(deleted, []string{older}) {
+			t.Errorf("expected %s deleted, got %v\n", older, deleted)
+		}
+		for _, id := range []string{pinned, newer, fresh, running.Id} {
+			if !exists(id) {
+				t.Errorf("command %s was pruned\n", id)
+			}
+		}
+	})
+
+	t.Run("max log lines", func(t *testing.T) {
+		maxLogLines := 3
+		report, deleted, err := db.ApplyRetention(&RetentionPolicy{MaxLogLines: &maxLogLines}, now)
+		if err != nil {
+			t.Fatalf("ApplyRetention error: %s\n", err)
+		}
+		if len(deleted) != 0 || report.TrimmedCommands != 1 || report.DeletedLogs != 1 {
+			t.Errorf("unexpected report %+v\n", report)
+		}
+
+		logs, err := db.GetLogs(newer, "", 10)
+		if err != nil {
+			t.Fatalf("GetLogs error: %s\n", err)
+		}
+		if len(logs) != 3 || logs[len(logs)-1].Content != "line     1" {
+			t.Errorf("expected the newest 3 lines, got %v\n", logs)
+		}
+		// within the grace period
+		logs, err = db.GetLogs(fresh, "", 10)
+		if err != nil {
+			t.Fatalf("GetLogs error: %s\n", err)
+		}
+		if len(logs) != 4 {
+			t.Errorf("fresh command lost logs\n")
+		}
+	})
+
+	t.Run("max log bytes", func(t *testing.T) {
+		var maxLogBytes int64 = 25
+		report, _, err := db.ApplyRetention(&RetentionPolicy{MaxLogBytes: &maxLogBytes}, now)
+		if err != nil {
+			t.Fatalf("ApplyRetention error: %s\n", err)
+		}
+		if report.DeletedLogs != 1 || report.DeletedBytes != 10 {
+			t.Errorf("unexpected report %+v\n", report)
+		}
+		logs, err := db.GetLogs(newer, "", 10)
+		if err != nil {
+			t.Fatalf("GetLogs error: %s\n", err)
+		}
+		if len(logs) != 2 {
+			t.Errorf("expected 2 lines left, got %d\n", len(logs))
+		}
+		logs, err = db.GetLogs(pinned, "", 10)
+		if err != nil {
+			t.Fatalf("GetLogs error: %s\n", err)
+		}
+		if len(logs) != 3 {
+			t.Errorf("pinned command lost logs\n")
+		}
+	})
+
+	t.Run("saved policy", func(t *testing.T) {
+		policy, err := db.GetRetentionPolicy()
+		if err != nil {
+			t.Fatalf("GetRetentionPolicy error: %s\n", err)
+		}
+		if policy.MaxAgeDays != nil || policy.KeepFinished != nil {
+			t.Errorf("expected an empty policy, got %+v\n", policy)
+		}
+
+		keepFinished := 0
+		if err := db.SaveRetentionPolicy(&RetentionPolicy{KeepFinished: &keepFinished}); err != nil {
+			t.Fatalf("SaveRetentionPolicy error: %s\n", err)
+		}
+		bus := NewEventBus()
+		CreateTopic[any](bus, "command")
+		deletes := make(chan string, 10)
+		Sub(bus, "command", func(msg any) {
+			if event, ok := msg.(*CommandEvent); ok && event.Type == COMMAND_DELETE {
+				deletes <- event.Id
+			}
+		})
+
+		report, err := NewJanitor(db, bus).Run(now)
+		if err != nil {
+			t.Fatalf("Janitor.Run error: %s\n", err)
+		}
+		if report.DeletedCommands != 1 {
+			t.Errorf("unexpected report %+v\n", report)
+		}
+		if id := <-deletes; id != newer {
+			t.Errorf("expected delete event of %s, got %s\n", newer, id)
+		}
+	})
+}
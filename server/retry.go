@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+type RetryBackoff string
+
+// most attempts a retry policy may ask for
+const MAX_RETRY_ATTEMPTS = 100
+
+// longest wait between two attempts, whatever the policy says
+const MAX_RETRY_DELAY = 24 * time.Hour
+
+const (
+	BACKOFF_FIXED       RetryBackoff = "fixed"
+	BACKOFF_EXPONENTIAL RetryBackoff = "exponential"
+)
+
+// When and how often a failed command is started again. Each attempt is a
+// new command linked to the previous one through `rerunOf`.
+// Commands killed by a signal, including a manual stop, are never retried.
+type RetryPolicy struct {
+	// total number of attempts including the first one
+	MaxAttempts int          `json:"maxAttempts"`
+	Backoff     RetryBackoff `json:"backoff"`
+	DelayMs     int64        `json:"delayMs"`
+	// upper bound for exponential backoff, zero for none
+	MaxDelayMs int64 `json:"maxDelayMs"`
+	// retry commands exiting with a non-zero code, only `ExitCodes` if set
+	OnFailure bool  `json:"onFailure"`
+	ExitCodes []int `json:"exitCodes"`
+	OnTimeout bool  `json:"onTimeout"`
+}
+
+func (p *RetryPolicy) Value() (driver.Value, error) {
+	if p == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (p *RetryPolicy) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), p)
+	case []byte:
+		return json.Unmarshal(v, p)
+	default:
+		return fmt.Errorf("cannot scan %T into RetryPolicy", src)
+	}
+}
+
+// whether the way `command` finished is one the policy retries,
+// regardless of how many attempts are left
+func (p *RetryPolicy) Retryable(command *Command) bool {
+	switch command.Status {
+	case COMMAND_TIMED_OUT:
+		return p.OnTimeout
+	case COMMAND_ERROR:
+		if !p.OnFailure || command.ExitCode == nil || *command.ExitCode == 0 {
+			return false
+		}
+		return len(p.ExitCodes) == 0 || slices.Contains(p.ExitCodes, *command.ExitCode)
+	}
+	return false
+}
+
+// whether the dispatcher starts another attempt of the finished `command`
+func (c *Command) WillRetry() bool {
+	return c.Retry != nil && c.Retry.Retryable(c) && c.Attempt < c.Retry.MaxAttempts
+}
+
+// wait before the attempt following `attempt`, at most MAX_RETRY_DELAY
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	limit := MAX_RETRY_DELAY
+	if maxDelay := time.Duration(p.MaxDelayMs) * time.Millisecond; p.Backoff == BACKOFF_EXPONENTIAL && maxDelay > 0 {
+		limit = min(limit, maxDelay)
+	}
+	delay := min(time.Duration(p.DelayMs)*time.Millisecond, limit)
+	if p.Backoff != BACKOFF_EXPONENTIAL {
+		return delay
+	}
+
+	for range attempt - 1 {
+		// doubling past the limit could overflow
+		if delay >= limit/2 {
+			return limit
+		}
+		delay *= 2
+	}
+	return delay
+}
+
+// start the next attempt of a finished command if its retry policy says so
+func (d *Dispatcher) Retry(id string) {
+	command, err := d.DB.GetCommand(id)
+	if err != nil {
+		slog.Error("Dispatcher.Retry db.GetCommand", "id", id, "error", err)
+		return
+	}
+	policy := command.Retry
+	if policy == nil || !command.Status.IsFinished() {
+		return
+	}
+
+	if !policy.Retryable(command) {
+		return
+	}
+	if command.Attempt >= policy.MaxAttempts {
+		AddErrorLog(d.DB, id, fmt.Sprintf(
+			"attempt %d of %d failed, giving up", command.Attempt, policy.MaxAttempts,
+		))
+		return
+	}
+
+	delay := policy.Delay(command.Attempt)
+	AddErrorLog(d.DB, id, fmt.Sprintf(
+		"attempt %d of %d failed, retrying in %s", command.Attempt, policy.MaxAttempts, delay,
+	))
+
+	// the next attempt waits as PENDING so it survives a restart
+	next := RerunOf(command)
+	next.Status = COMMAND_PENDING
+	next.Attempt = command.Attempt + 1
+	retryAt := time.Now().Add(delay).UTC().Format(time.RFC3339Nano)
+	next.RetryAt = &retryAt
+	// the next attempt takes the node's place in its workflow
+	next.WorkflowId = command.WorkflowId
+	next.WorkflowNode = command.WorkflowNode
+	next.DependsOn = command.DependsOn
+
+	if err := d.checkQueue(next.Queue); err != nil {
+		slog.Error("Dispatcher.Retry d.checkQueue", "id", id, "error", err)
+		return
+	}
+	next, err = d.DB.NewCommand(next)
+	if err != nil {
+		slog.Error("Dispatcher.Retry db.NewCommand", "id", id, "error", err)
+		return
+	}
+	msg := CommandMessage(next, COMMAND_CREATE)
+	if err := Pub[any](d.Bus, "command", msg); err != nil {
+		slog.Error("failed to send create command message", "message", msg, "error", err)
+	}
+	slog.Info("retrying command", "id", id, "attempt", next.Attempt, "next", next.Id)
+
+	d.scheduleRetry(next)
+}
+
+// release the PENDING retry attempt `command` once it is due
+func (d *Dispatcher) scheduleRetry(command *Command) {
+	delay := time.Duration(0)
+	if retryAt, err := time.Parse(time.RFC3339Nano, *command.RetryAt); err == nil {
+		delay = max(time.Until(retryAt), 0)
+	}
+	time.AfterFunc(delay, func() {
+		d.release(command, "retry")
+	})
+}
+
+// schedule the retry attempts left PENDING by a previous server process
+func (d *Dispatcher) ResumeRetries() {
+	commands, err := d.DB.ListCommandsByStatus(COMMAND_PENDING)
+	if err != nil {
+		slog.Error("Dispatcher.ResumeRetries db.ListCommandsByStatus", "error", err)
+		return
+	}
+	for i := range commands {
+		if commands[i].RetryAt != nil {
+			d.scheduleRetry(&commands[i])
+		}
+	}
+}
+
+func migrateRetryAt(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE command ADD COLUMN retry_at TEXT;")
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	policy := &RetryPolicy{
+		Backoff:    BACKOFF_EXPONENTIAL,
+		DelayMs:    1000,
+		MaxDelayMs: 5000,
+	}
+	expected := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, delay := range expected {
+		if d := policy.Delay(i + 1); d != delay {
+			t.Errorf("Delay(%d) = %s, expected %s\n", i+1, d, delay)
+		}
+	}
+
+	policy.Backoff = BACKOFF_FIXED
+	if d := policy.Delay(3); d != time.Second {
+		t.Errorf("fixed Delay(3) = %s, expected 1s\n", d)
+	}
+
+	// doubling without a max delay must not overflow
+	policy = &RetryPolicy{Backoff: BACKOFF_EXPONENTIAL, DelayMs: 1000}
+	for _, attempt := range []int{20, 40, 80, MAX_RETRY_ATTEMPTS} {
+		if d := policy.Delay(attempt); d != MAX_RETRY_DELAY {
+			t.Errorf("Delay(%d) = %s, expected %s\n", attempt, d, MAX_RETRY_DELAY)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	dispatcher := NewDispatcher(db, runner, bus)
+	go dispatcher.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	policy := &RetryPolicy{MaxAttempts: 3, Backoff: BACKOFF_FIXED, OnFailure: true, ExitCodes: []int{3}}
+	command, err := dispatcher.Submit(&Command{Command: "exit 3", Retry: policy})
+	if err != nil {
+		t.Fatalf("Submit error: %s\n", err)
+	}
+
+	var lineage []Command
+	for range 50 {
+		time.Sleep(100 * time.Millisecond)
+		lineage, err = db.GetLineage(command.Id)
+		if err != nil {
+			t.Fatalf("GetLineage error: %s\n", err)
+		}
+		if len(lineage) == 3 && lineage[2].Status.IsFinished() {
+			break
+		}
+	}
+
+	if len(lineage) != 3 {
+		t.Fatalf("expected 3 attempts, got %d\n", len(lineage))
+	}
+	for i, attempt := range lineage {
+		if attempt.Attempt != i+1 {
+			t.Errorf("lineage[%d] attempt = %d\n", i, attempt.Attempt)
+		}
+		if attempt.Status != COMMAND_ERROR || attempt.ExitCode == nil || *attempt.ExitCode != 3 {
+			t.Errorf("lineage[%d] unexpected result %s %v\n", i, attempt.Status, attempt.ExitCode)
+		}
+	}
+}
+
+// a retry attempt left PENDING by a previous server process runs on start
+func TestResumeRetries(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	retryAt := time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	command, err := db.NewCommand(&Command{Command: "true", Status: COMMAND_PENDING, Attempt: 2, RetryAt: &retryAt})
+	if err != nil {
+		t.Fatalf("NewCommand error: %s\n", err)
+	}
+
+	dispatcher := NewDispatcher(db, runner, bus)
+	go dispatcher.Start()
+
+	for range 50 {
+		time.Sleep(100 * time.Millisecond)
+		command, err = db.GetCommand(command.Id)
+		if err != nil {
+			t.Fatalf("GetCommand error: %s\n", err)
+		}
+		if command.Status.IsFinished() {
+			break
+		}
+	}
+	if command.Status != COMMAND_EXITED {
+		t.Errorf("expected the retry to run, status %s\n", command.Status)
+	}
+}
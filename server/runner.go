@@ -1,89 +1,423 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
-	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type Runner interface {
+	// start `command`, it is marked ERROR and announced if it cannot start
 	Run(db DB, command *Command) error
-	Stop(id string) error
+	Stop(id string, policy StopPolicy) error
+	// send `sig` to the process group, SIGSTOP pauses and SIGCONT resumes it
+	Signal(id string, sig syscall.Signal) error
+	// take over a process group started by a previous server process
+	Adopt(db DB, command *Command) error
+	// change the terminal size of a command running with a tty
+	Resize(id string, rows uint16, cols uint16) error
+	// write to the stdin of a running command, `secret` input is not logged
+	Input(id string, data []byte, secret bool) error
+	CloseInput(id string) error
+	// receive the raw output of a running command and write to its stdin
+	Attach(id string) (*Terminal, error)
 }
 
+// How a running command is stopped: `Signal` is sent to the process group,
+// and if it is still alive after `Grace` the group is killed with SIGKILL.
+// Zero fields fall back to the runner's default policy.
+type StopPolicy struct {
+	Signal syscall.Signal
+	Grace  time.Duration
+}
+
+var DefaultStopPolicy = StopPolicy{
+	Signal: syscall.SIGTERM,
+	Grace:  10 * time.Second,
+}
+
+// how long to wait for the process to be reaped after SIGKILL
+const KILL_WAIT_TIMEOUT = 5 * time.Second
+
 type Session struct {
 	*Command
 	cmd    *exec.Cmd
 	cancel context.CancelFunc
+	db     DB
+	// closed after the process has exited and its status is written
+	done chan struct{}
+	// closed once the logs of the session are committed
+	logged     chan struct{}
+	stopPolicy StopPolicy
+	timedOut   atomic.Bool
+	paused     atomic.Bool
+	stopped    atomic.Bool
+	peakRss    atomic.Int64
+	// process group of the running process, commands run in their own group
+	pgid atomic.Int64
+	// master and slave end of the terminal for commands running with a tty
+	pty *os.File
+	tty *os.File
+	// nil unless the command was started with stdin or a tty
+	stdin       io.WriteCloser
+	stdinMu     sync.Mutex
+	stdinClosed bool
+	// raw output for attached terminals, nil for adopted sessions
+	output     *TerminalOutput
+	lineReader LineReader
+	progress   *ProgressTracker
+	// cgroup enforcing the command's limits, nil without limits or cgroup v2
+	cgroup *Cgroup
+	// rlimits were set before exec by a wrapper of the command
+	rlimitsSet bool
+	// removes files created to run the command
+	cleanup func()
+	// how often the process group is sampled, zero disables sampling
+	sampleInterval time.Duration
+	bus            *EventBus
 }
 
 type CockpitRunner struct {
-	Bus      *EventBus
-	Sessions map[string]*Session
+	Bus *EventBus
+	// guards Sessions, commands are run from handlers, the dispatcher,
+	// the scheduler and retry timers at the same time
+	mu         sync.RWMutex
+	Sessions   map[string]*Session
+	StopPolicy StopPolicy
+	// how output is split into log lines
+	LineReader LineReader
+	// how often resource usage of running commands is sampled
+	SampleInterval time.Duration
+	// nil when no writable cgroup v2 is available, limits then use setrlimit
+	Cgroups *Cgroups
 }
 
 func NewRunner(bus *EventBus) Runner {
 	sessions := make(map[string]*Session)
 	runner := CockpitRunner{
-		Sessions: sessions,
-		Bus:      bus,
+		Sessions:   sessions,
+		Bus:        bus,
+		StopPolicy: DefaultStopPolicy,
+		LineReader: DefaultLineReader,
+
+		SampleInterval: RESOURCE_SAMPLE_INTERVAL,
+	}
+
+	cgroups, err := DetectCgroups()
+	if err != nil {
+		slog.Info("command limits fall back to setrlimit", "reason", err)
 	}
+	runner.Cgroups = cgroups
 	return &runner
 }
 
-func (r *CockpitRunner) Run(db DB, command *Command) error {
+// Start `command` in the background. The command is marked ERROR if it
+// cannot be started, here or later in its Waiter.
+func (r *CockpitRunner) Run(db DB, command *Command) (err error) {
+	args, cleanup, err := CommandArgs(command)
+	if err != nil {
+		slog.Error("cannot prepare command", "command", command.Command, "error", err)
+		FailCommand(db, r.Bus, command.Id, fmt.Sprintf("cannot prepare command: %s", err))
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, "bash", "-c", command.Command)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = command.Cwd
+	if len(command.Env) > 0 {
+		cmd.Env = append(os.Environ(), command.Env.Environ()...)
+	}
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	session := &Session{
 		Command: command,
 		cmd:     cmd,
 		cancel:  cancel,
+		cleanup: cleanup,
+		db:      db,
+		done:    make(chan struct{}),
+		logged:  make(chan struct{}),
+		output:  NewTerminalOutput(),
+		bus:     r.Bus,
+
+		stopPolicy: r.StopPolicy,
+		lineReader: r.LineReader,
+		progress:   NewProgressTracker(),
+
+		sampleInterval: r.SampleInterval,
 	}
-	r.Sessions[command.Id] = session
+	defer func() {
+		if err == nil {
+			return
+		}
+		cancel()
+		if session.pty != nil {
+			session.pty.Close()
+			session.tty.Close()
+		}
+		session.removeCgroup()
+		cleanup()
+		FailCommand(db, r.Bus, command.Id, fmt.Sprintf("failed to start command: %s", err))
+	}()
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		slog.Error("cannot get stdout", "command", command.Command, "error", err)
-		return err
+	var wg sync.WaitGroup
+	if command.Tty {
+		pty, tty, err := OpenPty()
+		if err != nil {
+			slog.Error("cannot open pty", "command", command.Command, "error", err)
+			return err
+		}
+		rows, cols := command.TtySize()
+		if err := SetPtySize(pty, rows, cols); err != nil {
+			slog.Error("cannot set pty size", "command", command.Command, "error", err)
+		}
+		session.pty = pty
+		session.tty = tty
+
+		// the tty becomes the controlling terminal of a new session
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+		cmd.Stdin = tty
+		cmd.Stdout = tty
+		cmd.Stderr = tty
+		session.stdin = pty
+
+		wg.Add(1)
+		go session.Drainer(&wg, r.Bus, command, PtyReader{pty}, LOG_STDOUT)
+	} else {
+		if command.Stdin {
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				slog.Error("cannot get stdin", "command", command.Command, "error", err)
+				return err
+			}
+			session.stdin = stdin
+		}
+
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			slog.Error("cannot get stdout", "command", command.Command, "error", err)
+			return err
+		}
+
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			slog.Error("cannot get stderr", "command", command.Command, "error", err)
+			return err
+		}
+
+		wg.Add(2)
+		go session.Drainer(&wg, r.Bus, command, stdout, LOG_STDOUT)
+		go session.Drainer(&wg, r.Bus, command, stderr, LOG_STDERR)
 	}
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		slog.Error("cannot get stderr", "command", command.Command, "error", err)
-		return err
+	if command.Limits != nil && r.Cgroups != nil {
+		cgroup, err := r.Cgroups.New(command.Id, command.Limits)
+		if err != nil {
+			AddErrorLog(db, command.Id, fmt.Sprintf("cannot create cgroup, limits fall back to setrlimit: %s", err))
+		} else {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = cgroup.Fd()
+			session.cgroup = cgroup
+		}
+	}
+	// a program that cannot be found fails the start as it is
+	if command.Limits != nil && cmd.Err == nil {
+		if wrapped, ok := command.Limits.WrapArgs(cmd.Args, session.cgroup); ok {
+			cmd.Path = wrapped[0]
+			cmd.Args = wrapped
+			session.rlimitsSet = true
+		}
 	}
 
-	_, err = CreateTopic[*Log](r.Bus, command.Id)
-	if err != nil {
+	if _, err := CreateTopic[*Log](r.Bus, command.Id); err != nil {
+		slog.Error("CockpitRunner.Run", "error", err)
+	}
+	if _, err := CreateTopic[*ResourceSample](r.Bus, ResourceTopic(command.Id)); err != nil {
 		slog.Error("CockpitRunner.Run", "error", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go session.Drainer(&wg, r.Bus, command, stdout, LOG_STDOUT)
-	go session.Drainer(&wg, r.Bus, command, stderr, LOG_STDERR)
-	go session.Logger(db, r.Bus, command)
+	// registered once nothing can fail, Stop, Attach and Input find the
+	// session only while its Waiter is going to finish it
+	r.addSession(session)
+
+	// subscribe before any output or input can be published
+	session.Logger(db, r.Bus, command)
 	go session.Waiter(&wg, db, r.Bus, command)
 
 	return nil
 }
 
-func (r *CockpitRunner) Stop(id string) error {
-	session := r.Sessions[id]
+func (r *CockpitRunner) addSession(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Sessions[session.Command.Id] = session
+}
+
+// nil if no command with `id` was run
+func (r *CockpitRunner) session(id string) *Session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Sessions[id]
+}
+
+func (r *CockpitRunner) Stop(id string, policy StopPolicy) error {
+	session := r.session(id)
 	if session == nil {
 		return fmt.Errorf("CockpitRunner no session with id %s\n", id)
 	}
 
-	return session.Stop()
+	if policy.Signal == 0 {
+		policy.Signal = r.StopPolicy.Signal
+	}
+	if policy.Grace == 0 {
+		policy.Grace = r.StopPolicy.Grace
+	}
+	return session.Stop(policy)
+}
+
+func (r *CockpitRunner) Signal(id string, sig syscall.Signal) error {
+	session := r.session(id)
+	if session == nil {
+		return fmt.Errorf("CockpitRunner no session with id %s\n", id)
+	}
+
+	return session.Signal(sig)
+}
+
+func (r *CockpitRunner) Resize(id string, rows uint16, cols uint16) error {
+	session := r.session(id)
+	if session == nil {
+		return fmt.Errorf("CockpitRunner no session with id %s\n", id)
+	}
+	if session.pty == nil {
+		return fmt.Errorf("session %s is not running with a tty", id)
+	}
+
+	return SetPtySize(session.pty, rows, cols)
+}
+
+func (r *CockpitRunner) Input(id string, data []byte, secret bool) error {
+	session := r.session(id)
+	if session == nil {
+		return fmt.Errorf("CockpitRunner no session with id %s\n", id)
+	}
+
+	return session.Input(data, secret)
+}
+
+func (r *CockpitRunner) CloseInput(id string) error {
+	session := r.session(id)
+	if session == nil {
+		return fmt.Errorf("CockpitRunner no session with id %s\n", id)
+	}
+
+	return session.CloseInput()
+}
+
+func (r *CockpitRunner) Attach(id string) (*Terminal, error) {
+	session := r.session(id)
+	if session == nil {
+		return nil, fmt.Errorf("CockpitRunner no session with id %s\n", id)
+	}
+
+	return session.Attach()
+}
+
+func (r *CockpitRunner) Adopt(db DB, command *Command) error {
+	if command.Pgid == nil || command.StartedAt == nil {
+		return fmt.Errorf("command %s has no process group", command.Id)
+	}
+	started, err := time.Parse(time.RFC3339Nano, *command.StartedAt)
+	if err != nil {
+		return err
+	}
+
+	session := &Session{
+		Command: command,
+		cancel:  func() {},
+		db:      db,
+		done:    make(chan struct{}),
+		bus:     r.Bus,
+
+		stopPolicy:     r.StopPolicy,
+		sampleInterval: r.SampleInterval,
+	}
+	session.pgid.Store(int64(*command.Pgid))
+	session.paused.Store(command.Status == COMMAND_PAUSED)
+	r.addSession(session)
+
+	AddErrorLog(db, command.Id, fmt.Sprintf(
+		"server restarted, adopted process group %d, output is no longer captured", *command.Pgid,
+	))
+	if _, err := CreateTopic[*ResourceSample](r.Bus, ResourceTopic(command.Id)); err != nil {
+		slog.Error("CockpitRunner.Adopt", "error", err)
+	}
+	go session.Watcher(db, r.Bus, started)
+
+	return nil
+}
+
+// how often an adopted process group is checked for exit
+const ADOPTED_POLL_INTERVAL = 1 * time.Second
+
+// wait for an adopted process group to exit, its exit status cannot be
+// collected since it is not a child of this process
+func (s *Session) Watcher(db DB, bus *EventBus, started time.Time) {
+	defer func() {
+		if err := CloseTopic[*ResourceSample](bus, ResourceTopic(s.Id)); err != nil {
+			slog.Error("Session.Watcher", "error", err)
+		}
+		close(s.done)
+	}()
+
+	if limit, ok := s.TimeLimit(started); ok {
+		timer := time.AfterFunc(limit, s.Timeout)
+		defer timer.Stop()
+	}
+
+	if s.sampleInterval > 0 {
+		go s.Sampler(db, bus, s.sampleInterval)
+	}
+
+	pgid := int(s.pgid.Load())
+	ticker := time.NewTicker(ADOPTED_POLL_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := syscall.Kill(-pgid, 0); err == syscall.ESRCH {
+			break
+		}
+	}
+
+	finished := time.Now().UTC()
+	finishedAt := finished.Format(time.RFC3339Nano)
+	durationMs := finished.Sub(started).Milliseconds()
+	result := &Command{
+		Id:         s.Id,
+		Status:     COMMAND_EXITED,
+		StartedAt:  s.StartedAt,
+		FinishedAt: &finishedAt,
+		DurationMs: &durationMs,
+		PeakRss:    s.SampledPeakRss(),
+		TermReason: s.TermReason(),
+	}
+	if s.timedOut.Load() {
+		result.Status = COMMAND_TIMED_OUT
+	}
+	AddErrorLog(db, s.Id, "adopted process group exited, exit status is unknown")
+
+	db.UpdateFinished(result)
+	msg := CommandMessage(result, COMMAND_UPDATE)
+	if err := Pub[any](bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
 }
 
 func SplitLines(buf []byte) ([]string, int) {
@@ -103,34 +437,50 @@ func SplitLines(buf []byte) ([]string, int) {
 // read pipe and write to channel
 func (s *Session) Drainer(wg *sync.WaitGroup, bus *EventBus, command *Command, reader io.ReadCloser, fd LogFD) {
 	defer wg.Done()
-	scanner := bufio.NewScanner(reader)
-
-	for scanner.Scan() {
-		line := scanner.Text()
+	err := s.lineReader.ReadLines(io.TeeReader(reader, s.output), func(line Line) {
 		log := &Log{
-			Id:        IdGen(),
+			Id:        line.Id,
 			CommandId: s.Id,
-			CreatedAt: FormatNow(),
-			Content:   line,
+			CreatedAt: line.CreatedAt,
+			Content:   line.Content,
 			FD:        fd,
 		}
-		slog.Info("[IN] ", "content", line, "time", log.CreatedAt)
+		slog.Info("[IN] ", "content", line.Content, "time", log.CreatedAt)
 		Pub(bus, log.CommandId, log)
-	}
 
-	if err := scanner.Err(); err != nil {
+		if progress := s.progress.Track(line.Content); progress != nil {
+			msg := ProgressMessage(s.Id, progress)
+			if err := Pub[any](bus, "command", msg); err != nil {
+				slog.Error("failed to send progress command message", "message", msg, "error", err)
+			}
+		}
+	})
+	if err != nil {
 		slog.Error("Drainer", "error", err)
 	}
 }
 
-// write log to db
+// queue logs for the db until the log topic is closed, then flush them
+// and close `logged`
 func (s *Session) Logger(db DB, bus *EventBus, command *Command) {
-	_, err := Sub(bus, command.Id, func(log *Log) {
-		db.AddLog(log)
-	})
+	rc, _, err := SubChan[*Log](bus, command.Id)
 	if err != nil {
 		slog.Error("Logger", "error", err)
+		close(s.logged)
+		return
 	}
+
+	go func() {
+		defer close(s.logged)
+		for log := range rc {
+			db.QueueLog(log)
+		}
+		if dropped := db.FlushLogs(command.Id); dropped > 0 {
+			AddErrorLog(db, command.Id, fmt.Sprintf(
+				"%d log lines were dropped, the database could not keep up", dropped,
+			))
+		}
+	}()
 }
 
 // resposible for startup and cleanup
@@ -140,127 +490,390 @@ func (s *Session) Waiter(wg *sync.WaitGroup, db DB, bus *EventBus, command *Comm
 		if err != nil {
 			slog.Error("Session.Waiter", "error", err)
 		}
+		if err := CloseTopic[*ResourceSample](bus, ResourceTopic(command.Id)); err != nil {
+			slog.Error("Session.Waiter", "error", err)
+		}
+		s.cleanup()
+		// attached terminals see the command done once their output ends
+		close(s.done)
+		s.output.Close()
 	}()
 
-	if err := s.cmd.Start(); err != nil {
+	err := s.cmd.Start()
+	// the child holds its own copy of the tty, keeping ours open would
+	// prevent the pty from reporting EOF once the command exits
+	if s.tty != nil {
+		s.tty.Close()
+	}
+	if err != nil {
+		if s.pty != nil {
+			s.pty.Close()
+		}
+		s.removeCgroup()
 		slog.Error("failed to start command", "command", s.Command, "error", err)
 
-		db.UpdateStatus(s.Id, COMMAND_ERROR)
+		finishedAt := FormatNow()
+		result := &Command{Id: s.Id, Status: COMMAND_ERROR, FinishedAt: &finishedAt}
+		db.UpdateFinished(result)
 		db.AddLog(&Log{
 			IdGen(),
 			s.Id,
 			FormatNow(),
-			fmt.Sprintf("failed to start command %s error: %s", s.Command, err),
+			fmt.Sprintf("failed to start command %s error: %s", s.Command.Command, err),
 			-1,
 		})
 
-		msg := CommandMessage(&Command{Id: s.Id, Status: COMMAND_ERROR}, COMMAND_UPDATE)
+		msg := CommandMessage(result, COMMAND_UPDATE)
 		if err := Pub[any](bus, "command", msg); err != nil {
 			slog.Error("failed to send update command message", "message", msg, "error", err)
 		}
 
 		return
 	}
+	started := time.Now().UTC()
+	startedAt := started.Format(time.RFC3339Nano)
+	pid := s.cmd.Process.Pid
+	s.pgid.Store(int64(pid))
+	if s.Limits != nil {
+		for _, err := range s.Limits.Apply(pid, pid, s.cgroup, s.rlimitsSet) {
+			AddErrorLog(db, s.Id, fmt.Sprintf("limit not applied: %s", err))
+		}
+	}
 	db.UpdateStatus(s.Id, COMMAND_RUNNING)
-	msg := CommandMessage(&Command{Id: s.Id, Status: COMMAND_RUNNING}, COMMAND_UPDATE)
+	db.UpdateStarted(s.Id, startedAt, pid, pid)
+	msg := CommandMessage(&Command{
+		Id:        s.Id,
+		Status:    COMMAND_RUNNING,
+		StartedAt: &startedAt,
+		Pid:       &pid,
+		Pgid:      &pid,
+	}, COMMAND_UPDATE)
 	if err := Pub[any](bus, "command", msg); err != nil {
 		slog.Error("failed to send update command message", "message", msg, "error", err)
 	}
-	wg.Wait()
 
-	if err := s.cmd.Wait(); err != nil {
-		slog.Error("failed to wait command", "command", s.Command, "error", err)
+	if limit, ok := s.TimeLimit(started); ok {
+		timer := time.AfterFunc(limit, s.Timeout)
+		defer timer.Stop()
+	}
+	if s.sampleInterval > 0 {
+		go s.Sampler(db, bus, s.sampleInterval)
+	}
+	wg.Wait()
 
-		db.UpdateStatus(s.Id, COMMAND_ERROR)
+	waitErr := s.cmd.Wait()
+	if s.pty != nil {
+		s.pty.Close()
+	}
+	finished := time.Now().UTC()
+	result := ExitResult(s.cmd.ProcessState)
+	result.Id = s.Id
+	result.StartedAt = &startedAt
+	finishedAt := finished.Format(time.RFC3339Nano)
+	result.FinishedAt = &finishedAt
+	durationMs := finished.Sub(started).Milliseconds()
+	result.DurationMs = &durationMs
+	result.PeakRss = s.SampledPeakRss()
+
+	result.Status = COMMAND_EXITED
+	if waitErr != nil {
+		slog.Error("failed to wait command", "command", s.Command, "error", waitErr)
+
+		result.Status = COMMAND_ERROR
 		db.AddLog(&Log{
 			IdGen(),
 			s.Id,
 			FormatNow(),
-			fmt.Sprintf("failed to wait command %s error: %s", s.Command, err),
+			fmt.Sprintf("failed to wait command %s error: %s", s.Command.Command, waitErr),
 			-1,
 		})
+	}
+	if s.timedOut.Load() {
+		result.Status = COMMAND_TIMED_OUT
+	}
+	result.TermReason = s.TermReason()
+	if result.TermReason != nil && *result.TermReason == TERM_OOM {
+		AddErrorLog(db, s.Id, "killed for exceeding its memory limit")
+	}
+	s.removeCgroup()
 
-		msg := CommandMessage(&Command{Id: s.Id, Status: COMMAND_ERROR}, COMMAND_UPDATE)
-		if err := Pub[any](bus, "command", msg); err != nil {
-			slog.Error("failed to send update command message", "message", msg, "error", err)
-		}
-
-		return
+	// commit every log before the command is reported as finished
+	if err := CloseTopic[*Log](bus, command.Id); err != nil {
+		slog.Error("Session.Waiter", "error", err)
 	}
-	db.UpdateStatus(s.Id, COMMAND_EXITED)
-	msg = CommandMessage(&Command{Id: s.Id, Status: COMMAND_EXITED}, COMMAND_UPDATE)
+	<-s.logged
+
+	db.UpdateFinished(result)
+	msg = CommandMessage(result, COMMAND_UPDATE)
 	if err := Pub[any](bus, "command", msg); err != nil {
 		slog.Error("failed to send update command message", "message", msg, "error", err)
 	}
 }
 
-func (s *Session) Stop() error {
-	slog.Info("Trying to kill cmd", "process pid", s.cmd.Process.Pid)
-
-	if s.cmd != nil && s.cmd.Process != nil {
-		pgid, err := syscall.Getpgid(s.cmd.Process.Pid)
+// time left until the command's timeout or deadline, whichever comes first
+func (s *Session) TimeLimit(started time.Time) (time.Duration, bool) {
+	var limit time.Time
+	if s.TimeoutMs != nil {
+		limit = started.Add(time.Duration(*s.TimeoutMs) * time.Millisecond)
+	}
+	if s.Deadline != nil {
+		deadline, err := time.Parse(time.RFC3339Nano, *s.Deadline)
 		if err != nil {
-			return err
+			slog.Error("Session.TimeLimit invalid deadline", "deadline", *s.Deadline, "error", err)
+		} else if limit.IsZero() || deadline.Before(limit) {
+			limit = deadline
 		}
+	}
 
-		slog.Info("Stop", "cmd", "kill -9", "pgid", pgid)
-		cmd := exec.Command("kill", "-9", "--", fmt.Sprintf("-%d", pgid))
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
-			return err
-		}
+	if limit.IsZero() {
+		return 0, false
 	}
+	return time.Until(limit), true
+}
 
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "kill -9")
-		cmd := exec.Command("kill", "-9", strconv.Itoa(s.cmd.Process.Pid))
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
-			return err
-		}
+// write `data` to stdin and record it as a LOG_STDIN line
+func (s *Session) Input(data []byte, secret bool) error {
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+
+	if err := s.checkInput(); err != nil {
+		return err
 	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "kill")
-		cmd := exec.Command("kill", strconv.Itoa(s.cmd.Process.Pid))
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
-			return err
-		}
+	if _, err := s.stdin.Write(data); err != nil {
+		return err
 	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "s.cmd.Process.Kill")
-		if err := s.cmd.Process.Kill(); err != nil {
-			return err
-		}
+
+	content := strings.TrimSuffix(string(data), "\n")
+	if secret {
+		content = "[hidden input]"
 	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "s.cmd.Process.Signal(syscall.SIGINT)")
-		if err := s.cmd.Process.Signal(syscall.SIGINT); err != nil {
-			return err
-		}
+	s.publishInput(content)
+	return nil
+}
+
+// close stdin so the command reads EOF, tty commands receive ^D instead
+func (s *Session) CloseInput() error {
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+
+	if err := s.checkInput(); err != nil {
+		return err
 	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "s.cmd.Process.Signal(syscall.SIGKILL)")
-		if err := s.cmd.Process.Signal(syscall.SIGKILL); err != nil {
+
+	if s.pty != nil {
+		if _, err := s.stdin.Write([]byte{0x04}); err != nil {
 			return err
 		}
+		s.publishInput("^D")
+		return nil
 	}
-	if s.cmd != nil && s.cmd.Process != nil {
-		slog.Info("Stop", "cmd", "s.cmd.Process.Signal(syscall.SIGTERM)")
-		if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
-			return err
-		}
+
+	s.stdinClosed = true
+	if err := s.stdin.Close(); err != nil {
+		return err
 	}
-	if s.cmd != nil {
-		slog.Info("Stop", "cmd", "s.cmd.Cancel")
-		if err := s.cmd.Cancel(); err != nil {
-			return err
-		}
+	s.publishInput("[stdin closed]")
+	return nil
+}
+
+func (s *Session) checkInput() error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("command %s has finished", s.Id)
+	default:
+	}
+	if s.stdin == nil {
+		return fmt.Errorf("command %s was not started with stdin", s.Id)
+	}
+	if s.stdinClosed {
+		return fmt.Errorf("stdin of command %s is closed", s.Id)
 	}
-	s.cancel()
 	return nil
 }
 
+func (s *Session) publishInput(content string) {
+	log := &Log{
+		Id:        IdGen(),
+		CommandId: s.Id,
+		CreatedAt: FormatNow(),
+		Content:   content,
+		FD:        LOG_STDIN,
+	}
+	if err := Pub(s.bus, s.Id, log); err != nil {
+		slog.Error("Session.publishInput", "error", err)
+	}
+}
+
+// stop the command because it ran past its time limit
+func (s *Session) Timeout() {
+	s.timedOut.Store(true)
+	AddErrorLog(s.db, s.Id, "command exceeded its time limit")
+	if err := s.Stop(s.stopPolicy); err != nil {
+		slog.Error("Session.Timeout", "error", err)
+	}
+}
+
+// why the finished command was killed, nil if it exited on its own
+func (s *Session) TermReason() *TermReason {
+	var reason TermReason
+	switch {
+	case s.cgroup != nil && s.cgroup.OOMKilled():
+		reason = TERM_OOM
+	case s.timedOut.Load():
+		reason = TERM_TIMEOUT
+	case s.stopped.Load():
+		reason = TERM_STOPPED
+	default:
+		return nil
+	}
+	return &reason
+}
+
+func (s *Session) removeCgroup() {
+	if s.cgroup == nil {
+		return
+	}
+	if err := s.cgroup.Remove(); err != nil {
+		slog.Error("Session.removeCgroup", "path", s.cgroup.Path, "error", err)
+	}
+}
+
+// exit code or terminating signal of a finished process
+func ExitResult(state *os.ProcessState) *Command {
+	result := &Command{}
+	if state == nil {
+		return result
+	}
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signal := int(status.Signal())
+		result.TermSignal = &signal
+		return result
+	}
+
+	exitCode := state.ExitCode()
+	result.ExitCode = &exitCode
+	return result
+}
+
+// Stop the process group following `policy` and block until the process exited
+func (s *Session) Stop(policy StopPolicy) error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+
+	pgid := int(s.pgid.Load())
+	if pgid == 0 {
+		return fmt.Errorf("session %s has no running process", s.Id)
+	}
+
+	s.stopped.Store(true)
+	AddErrorLog(s.db, s.Id, fmt.Sprintf(
+		"stopping, sending %s to process group %d", SignalName(policy.Signal), pgid,
+	))
+	if err := syscall.Kill(-pgid, policy.Signal); err == syscall.ESRCH {
+		// process is already gone, wait for the waiter to finish cleanup
+		<-s.done
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// a paused process only acts on the signal once it is continued
+	if s.paused.Load() {
+		syscall.Kill(-pgid, syscall.SIGCONT)
+	}
+
+	select {
+	case <-s.done:
+		s.cancel()
+		return nil
+	case <-time.After(policy.Grace):
+	}
+
+	AddErrorLog(s.db, s.Id, fmt.Sprintf(
+		"process group %d did not exit %s after %s, sending SIGKILL",
+		pgid, policy.Grace, SignalName(policy.Signal),
+	))
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+
+	select {
+	case <-s.done:
+		s.cancel()
+		return nil
+	case <-time.After(KILL_WAIT_TIMEOUT):
+		return fmt.Errorf("process group %d did not exit after SIGKILL", pgid)
+	}
+}
+
+// Send `sig` to the process group. SIGSTOP marks the command PAUSED
+// and SIGCONT marks it RUNNING again.
+func (s *Session) Signal(sig syscall.Signal) error {
+	select {
+	case <-s.done:
+		return fmt.Errorf("command %s has finished", s.Id)
+	default:
+	}
+
+	pgid := int(s.pgid.Load())
+	if pgid == 0 {
+		return fmt.Errorf("session %s has no running process", s.Id)
+	}
+
+	AddErrorLog(s.db, s.Id, fmt.Sprintf(
+		"sending %s to process group %d", SignalName(sig), pgid,
+	))
+	if err := syscall.Kill(-pgid, sig); err != nil {
+		return err
+	}
+
+	var status CommandStatus
+	switch {
+	case sig == syscall.SIGSTOP && !s.paused.Swap(true):
+		status = COMMAND_PAUSED
+	case sig == syscall.SIGCONT && s.paused.Swap(false):
+		status = COMMAND_RUNNING
+	default:
+		return nil
+	}
+
+	// the process may have exited right after the signal
+	if err := s.db.UpdateRunningStatus(s.Id, status); err != nil {
+		return nil
+	}
+	msg := CommandMessage(&Command{Id: s.Id, Status: status}, COMMAND_UPDATE)
+	if err := Pub[any](s.bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+	return nil
+}
+
+// mark a command that could not be started ERROR with `content` as its
+// error log and announce it
+func FailCommand(db DB, bus *EventBus, commandId string, content string) {
+	finishedAt := FormatNow()
+	result := &Command{Id: commandId, Status: COMMAND_ERROR, FinishedAt: &finishedAt}
+	if err := db.UpdateFinished(result); err != nil {
+		slog.Error("FailCommand db.UpdateFinished", "id", commandId, "error", err)
+	}
+	AddErrorLog(db, commandId, content)
+
+	msg := CommandMessage(result, COMMAND_UPDATE)
+	if err := Pub[any](bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+}
+
+func AddErrorLog(db DB, commandId string, content string) {
+	slog.Error("command error", "id", commandId, "content", content)
+	db.AddLog(&Log{
+		Id:        IdGen(),
+		CommandId: commandId,
+		CreatedAt: FormatNow(),
+		Content:   content,
+		FD:        LOG_ERROR,
+	})
+}
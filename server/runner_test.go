@@ -2,8 +2,13 @@ package main
 
 import (
 	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestChan(t *testing.T) {
@@ -56,7 +61,7 @@ func TestRunner(t *testing.T) {
 	// commandInfo, err := db.NewCommand("tail -f /mnt/d/vod/memo.dat")
 	// commandInfo, err := db.NewCommand("ls -alh /mnt/d/vod")
 	// commandInfo, err := db.NewCommand("ls -alh")
-	command, err := db.NewCommand("while true; do date; sleep 1; done")
+	command, err := db.NewCommand(&Command{Command: "while true; do date; sleep 1; done"})
 	if err != nil {
 		t.Errorf("db NewCommand error: %s\n", err)
 	}
@@ -101,7 +106,14 @@ func TestRunner(t *testing.T) {
 			slog.Info("[OUT]", "content", log.Content, "time", log.CreatedAt)
 			if cnt > 5 {
 				slog.Info("[STOP]", "id", command.Id)
-				runner.Stop(command.Id)
+				// keep draining so the process can exit while Stop waits for it
+				go func() {
+					for range rc {
+					}
+				}()
+				if err := runner.Stop(command.Id, StopPolicy{}); err != nil {
+					t.Errorf("runner.Stop error: %s\n", err)
+				}
 				unsub()
 				return
 			}
@@ -111,3 +123,586 @@ func TestRunner(t *testing.T) {
 	wg.Wait()
 }
 
+
+func TestRunnerStopEscalation(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	// ignored signals are inherited, so only SIGKILL stops this
+	command, err := db.NewCommand(&Command{Command: "trap '' TERM; sleep 30"})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	policy := StopPolicy{Signal: syscall.SIGTERM, Grace: 300 * time.Millisecond}
+	if err := runner.Stop(command.Id, policy); err != nil {
+		t.Fatalf("runner.Stop error: %s\n", err)
+	}
+
+	stopped, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if stopped.TermSignal == nil || *stopped.TermSignal != int(syscall.SIGKILL) {
+		t.Errorf("expected SIGKILL term signal, got %v\n", stopped.TermSignal)
+	}
+
+	logs, err := db.GetLogs(command.Id, "", 10)
+	if err != nil {
+		t.Fatalf("db GetLogs error: %s\n", err)
+	}
+	escalated := false
+	for _, log := range logs {
+		if log.FD == LOG_ERROR && strings.Contains(log.Content, "sending SIGKILL") {
+			escalated = true
+		}
+	}
+	if !escalated {
+		t.Errorf("no SIGKILL escalation log found\n")
+	}
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	timeoutMs := int64(300)
+	command, err := db.NewCommand(&Command{Command: "sleep 30", TimeoutMs: &timeoutMs})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+
+	rc, _, err := SubChan[any](bus, "command")
+	if err != nil {
+		t.Fatalf("SubChan command error: %s\n", err)
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case evt := <-rc:
+			msg := evt.(*CommandEvent)
+			if msg.Id != command.Id || !msg.Status.IsFinished() {
+				continue
+			}
+			if msg.Status != COMMAND_TIMED_OUT {
+				t.Errorf("expected TIMED_OUT status, got %s\n", msg.Status)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("command did not time out\n")
+		}
+	}
+}
+
+func TestRecoverCommands(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	// a process left behind by a previous server
+	proc := exec.Command("sleep", "30")
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := proc.Start(); err != nil {
+		t.Fatalf("proc.Start error: %s\n", err)
+	}
+	go proc.Wait()
+
+	alive, err := db.NewCommand(&Command{Command: "sleep 30"})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	db.UpdateStatus(alive.Id, COMMAND_RUNNING)
+	db.UpdateStarted(alive.Id, FormatNow(), proc.Process.Pid, proc.Process.Pid)
+
+	idle, err := db.NewCommand(&Command{Command: "true"})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := RecoverCommands(db, runner, bus); err != nil {
+		t.Fatalf("RecoverCommands error: %s\n", err)
+	}
+
+	if command, _ := db.GetCommand(idle.Id); command.Status != COMMAND_LOST {
+		t.Errorf("expected idle command to be LOST, got %s\n", command.Status)
+	}
+	if command, _ := db.GetCommand(alive.Id); command.Status != COMMAND_RUNNING {
+		t.Errorf("expected alive command to be adopted, got %s\n", command.Status)
+	}
+
+	policy := StopPolicy{Signal: syscall.SIGTERM, Grace: time.Second}
+	if err := runner.Stop(alive.Id, policy); err != nil {
+		t.Fatalf("runner.Stop error: %s\n", err)
+	}
+	if command, _ := db.GetCommand(alive.Id); command.Status != COMMAND_EXITED {
+		t.Errorf("expected adopted command to be EXITED, got %s\n", command.Status)
+	}
+}
+
+func TestRunnerTty(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	rows, cols := 40, 132
+	command, err := db.NewCommand(&Command{
+		Command: "test -t 1 && stty size",
+		Tty:     true,
+		TtyRows: &rows,
+		TtyCols: &cols,
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+
+	lines := []string{}
+	for range 20 {
+		time.Sleep(100 * time.Millisecond)
+		logs, err := db.GetLogs(command.Id, "", 10)
+		if err != nil {
+			t.Fatalf("db GetLogs error: %s\n", err)
+		}
+		lines = lines[:0]
+		for _, log := range logs {
+			lines = append(lines, log.Content)
+		}
+		if slices.Contains(lines, "40 132") {
+			return
+		}
+	}
+	t.Errorf("expected tty of size 40 132, got %q\n", lines)
+}
+
+func TestRunnerInput(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	command, err := db.NewCommand(&Command{
+		Command: "read name; echo \"hello $name\"; cat",
+		Stdin:   true,
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	if err := runner.Input(command.Id, []byte("world\n"), false); err != nil {
+		t.Fatalf("runner.Input error: %s\n", err)
+	}
+	if err := runner.Input(command.Id, []byte("hunter2\n"), true); err != nil {
+		t.Fatalf("runner.Input error: %s\n", err)
+	}
+	// cat exits on EOF
+	if err := runner.CloseInput(command.Id); err != nil {
+		t.Fatalf("runner.CloseInput error: %s\n", err)
+	}
+	<-runner.(*CockpitRunner).session(command.Id).done
+
+	logs, err := db.GetLogs(command.Id, "", 10)
+	if err != nil {
+		t.Fatalf("db GetLogs error: %s\n", err)
+	}
+	stdin, stdout := []string{}, []string{}
+	for _, log := range logs {
+		switch log.FD {
+		case LOG_STDIN:
+			stdin = append(stdin, log.Content)
+		case LOG_STDOUT:
+			stdout = append(stdout, log.Content)
+		}
+	}
+
+	if !slices.Contains(stdout, "hello world") {
+		t.Errorf("expected greeting in stdout, got %q\n", stdout)
+	}
+	if !slices.Contains(stdin, "world") || !slices.Contains(stdin, "[hidden input]") {
+		t.Errorf("expected recorded input, got %q\n", stdin)
+	}
+	if slices.Contains(stdin, "hunter2") {
+		t.Errorf("secret input was recorded\n")
+	}
+}
+
+func TestRunnerAttach(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	command, err := db.NewCommand(&Command{
+		Command: "printf 'ready>'; read name; echo \"hello $name\" >&2",
+		Stdin:   true,
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	// attach after the prompt was written so it comes from the scrollback
+	time.Sleep(200 * time.Millisecond)
+	terminal, err := runner.Attach(command.Id)
+	if err != nil {
+		t.Fatalf("runner.Attach error: %s\n", err)
+	}
+	if err := terminal.Write([]byte("world\n")); err != nil {
+		t.Fatalf("terminal.Write error: %s\n", err)
+	}
+
+	output := string(terminal.Scrollback)
+	for data := range terminal.Output {
+		output += string(data)
+	}
+	<-terminal.Done()
+
+	if output != "ready>hello world\n" {
+		t.Errorf("unexpected terminal output %q\n", output)
+	}
+	if _, err := runner.Attach(command.Id); err == nil {
+		t.Errorf("expected error attaching to a finished command\n")
+	}
+}
+
+func TestRunnerSignal(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	command, err := db.NewCommand(&Command{
+		Command: "trap 'echo usr1; exit 0' USR1; while true; do echo tick; sleep 0.05; done",
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := runner.Signal(command.Id, syscall.SIGSTOP); err != nil {
+		t.Fatalf("runner.Signal SIGSTOP error: %s\n", err)
+	}
+	paused, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if paused.Status != COMMAND_PAUSED {
+		t.Errorf("expected PAUSED, got %s\n", paused.Status)
+	}
+
+	// no output while paused
+	time.Sleep(100 * time.Millisecond)
+	before, _ := db.GetLogs(command.Id, "", 1000)
+	time.Sleep(300 * time.Millisecond)
+	after, _ := db.GetLogs(command.Id, "", 1000)
+	if len(after) != len(before) {
+		t.Errorf("paused command wrote %d lines\n", len(after)-len(before))
+	}
+
+	if err := runner.Signal(command.Id, syscall.SIGCONT); err != nil {
+		t.Fatalf("runner.Signal SIGCONT error: %s\n", err)
+	}
+	resumed, _ := db.GetCommand(command.Id)
+	if resumed.Status != COMMAND_RUNNING {
+		t.Errorf("expected RUNNING, got %s\n", resumed.Status)
+	}
+
+	if err := runner.Signal(command.Id, syscall.SIGUSR1); err != nil {
+		t.Fatalf("runner.Signal SIGUSR1 error: %s\n", err)
+	}
+	<-runner.(*CockpitRunner).session(command.Id).done
+
+	finished, _ := db.GetCommand(command.Id)
+	if finished.Status != COMMAND_EXITED || finished.ExitCode == nil || *finished.ExitCode != 0 {
+		t.Errorf("expected clean exit after SIGUSR1, got %s\n", finished.Status)
+	}
+	if err := runner.Signal(command.Id, syscall.SIGINT); err == nil {
+		t.Errorf("expected error signaling a finished command\n")
+	}
+}
+
+func TestRunnerResources(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	runner.(*CockpitRunner).SampleInterval = 100 * time.Millisecond
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	// hold a 16MB string in the shell
+	command, err := db.NewCommand(&Command{
+		Command: "x=$(head -c 16000000 /dev/zero | tr '\\0' a); sleep 0.5; echo ${#x}",
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	<-runner.(*CockpitRunner).session(command.Id).done
+
+	samples, err := db.GetResourceSamples(command.Id)
+	if err != nil {
+		t.Fatalf("db GetResourceSamples error: %s\n", err)
+	}
+	if len(samples) == 0 {
+		t.Fatalf("expected resource samples\n")
+	}
+	if samples[0].Processes == 0 || samples[0].Threads == 0 {
+		t.Errorf("unexpected sample %+v\n", samples[0])
+	}
+
+	finished, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if finished.PeakRss == nil || *finished.PeakRss < 16000000 {
+		t.Errorf("expected peak rss above 16MB, got %v\n", finished.PeakRss)
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	// rlimits only, cgroups depend on the host
+	runner.(*CockpitRunner).Cgroups = nil
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	nice := 5
+	limits := &NewLimits{Memory: "512M", MaxOpenFiles: 64, Nice: &nice, IoClass: "idle"}
+	converted, err := limits.ToLimits()
+	if err != nil {
+		t.Fatalf("ToLimits error: %s\n", err)
+	}
+
+	// rlimits are set before exec, nice right after the start
+	command, err := db.NewCommand(&Command{
+		Command: "ulimit -n; ulimit -v; sleep 0.2; nice",
+		Limits:  converted,
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+	<-runner.(*CockpitRunner).session(command.Id).done
+
+	logs, err := db.GetLogs(command.Id, "", 10)
+	if err != nil {
+		t.Fatalf("db GetLogs error: %s\n", err)
+	}
+	stdout := []string{}
+	for _, log := range logs {
+		if log.FD == LOG_STDOUT {
+			stdout = append([]string{log.Content}, stdout...)
+		}
+	}
+	if !slices.Equal(stdout, []string{"64", "524288", "5"}) {
+		t.Errorf("unexpected limits %q\n", stdout)
+	}
+
+	finished, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if finished.Limits == nil || finished.Limits.MemoryBytes != 512<<20 {
+		t.Errorf("limits were not stored, got %+v\n", finished.Limits)
+	}
+	if finished.TermReason != nil {
+		t.Errorf("expected no termination reason, got %s\n", *finished.TermReason)
+	}
+
+	// fallback without prlimit
+	args := ulimitArgs("bash", converted.rlimits(nil), []string{"sh", "-c", "ulimit -n; ulimit -v"})
+	output, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		t.Fatalf("ulimit wrapper error: %s\n", err)
+	}
+	if string(output) != "64\n524288\n" {
+		t.Errorf("unexpected ulimit wrapper limits %q\n", output)
+	}
+
+	for _, size := range []string{"", "12Q", "-1M"} {
+		if _, err := ParseByteSize(size); err == nil {
+			t.Errorf("ParseByteSize(%q) expected error\n", size)
+		}
+	}
+	if _, err := (&NewLimits{IoClass: "fast"}).ToLimits(); err == nil {
+		t.Errorf("expected invalid io class error\n")
+	}
+}
+
+func TestRunnerExec(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	cases := []struct {
+		request NewCommand
+		stdout  []string
+	}{
+		{NewCommand{Command: "echo $0", Exec: &ExecSpec{Mode: EXEC_SHELL, Shell: "sh"}}, []string{"sh"}},
+		{NewCommand{Exec: &ExecSpec{Mode: EXEC_ARGV, Argv: []string{"printf", "%s\\n", "a b", "$HOME;"}}}, []string{"a b", "$HOME;"}},
+		{NewCommand{Command: "x=1\necho $((x + 1))\n", Exec: &ExecSpec{Mode: EXEC_SCRIPT, Interpreter: []string{"sh", "-e"}}}, []string{"2"}},
+	}
+
+	for _, c := range cases {
+		command, err := c.request.ToCommand()
+		if err != nil {
+			t.Fatalf("ToCommand error: %s\n", err)
+		}
+		command, err = db.NewCommand(command)
+		if err != nil {
+			t.Fatalf("db NewCommand error: %s\n", err)
+		}
+		if err := runner.Run(db, command); err != nil {
+			t.Fatalf("runner.Run error: %s\n", err)
+		}
+		<-runner.(*CockpitRunner).session(command.Id).done
+
+		logs, _ := db.GetLogs(command.Id, "", 10)
+		stdout := []string{}
+		for _, log := range logs {
+			if log.FD == LOG_STDOUT {
+				stdout = append([]string{log.Content}, stdout...)
+			}
+		}
+		if !slices.Equal(stdout, c.stdout) {
+			t.Errorf("%s: expected %q, got %q\n", command.Command, c.stdout, stdout)
+		}
+
+		stored, _ := db.GetCommand(command.Id)
+		if stored.Exec == nil || stored.Exec.Mode != c.request.Exec.Mode {
+			t.Errorf("%s: exec spec was not stored\n", command.Command)
+		}
+	}
+
+	invalid := []*ExecSpec{
+		{Mode: "ssh"},
+		{Mode: EXEC_ARGV},
+		{Mode: EXEC_SHELL, Shell: "no-such-shell"},
+		{Mode: EXEC_SCRIPT, Argv: []string{"ls"}},
+	}
+	for _, spec := range invalid {
+		if err := spec.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid\n", spec)
+		}
+	}
+
+	if quoted := QuoteArgv([]string{"ls", "-la", "my file", "it's"}); quoted != `ls -la 'my file' 'it'\''s'` {
+		t.Errorf("unexpected quoting %s\n", quoted)
+	}
+}
+
+func TestRunnerRunFailure(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+	updates := make(chan *CommandEvent, 10)
+	Sub(bus, "command", func(msg any) {
+		if event, ok := msg.(*CommandEvent); ok && event.Type == COMMAND_UPDATE {
+			updates <- event
+		}
+	})
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	// the script cannot be written
+	t.Setenv("TMPDIR", t.TempDir()+"/missing")
+	command, err := db.NewCommand(&Command{Command: "echo hi", Exec: &ExecSpec{Mode: EXEC_SCRIPT}})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	if err := runner.Run(db, command); err == nil {
+		t.Fatalf("expected runner.Run error\n")
+	}
+
+	if err := runner.Stop(command.Id, StopPolicy{}); err == nil {
+		t.Errorf("expected no session for the failed command\n")
+	}
+	failed, err := db.GetCommand(command.Id)
+	if err != nil {
+		t.Fatalf("db GetCommand error: %s\n", err)
+	}
+	if failed.Status != COMMAND_ERROR || failed.FinishedAt == nil {
+		t.Errorf("expected the command to be marked ERROR, got %+v\n", failed)
+	}
+	select {
+	case event := <-updates:
+		if event.Id != command.Id || event.Status != COMMAND_ERROR {
+			t.Errorf("unexpected update %+v\n", event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no update published\n")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Command template started by the scheduler on a cron expression or once at `RunAt`
+type Schedule struct {
+	Id        string `json:"id"`
+	CreatedAt string `json:"createdAt"`
+	Name      string `json:"name"`
+	// cron expression, empty for one-off schedules
+	Cron string `json:"cron"`
+	// RFC3339 timestamp of a one-off run
+	RunAt *string `json:"runAt"`
+	// the command started each time the schedule fires
+	Spec    NewCommand `json:"spec"`
+	Enabled bool       `json:"enabled"`
+	// nil once a schedule will not fire again
+	NextRun       *string `json:"nextRun"`
+	LastRun       *string `json:"lastRun"`
+	LastCommandId *string `json:"lastCommandId"`
+}
+
+// next time the schedule fires after `t`, nil when it will not fire again
+func (s *Schedule) NextAfter(t time.Time) (*string, error) {
+	if len(s.Cron) > 0 {
+		cron, err := ParseCron(s.Cron)
+		if err != nil {
+			return nil, err
+		}
+		next := cron.Next(t.In(time.Local))
+		if next.IsZero() {
+			return nil, nil
+		}
+		formatted := next.UTC().Format(time.RFC3339Nano)
+		return &formatted, nil
+	}
+
+	if s.RunAt != nil {
+		runAt, err := time.Parse(time.RFC3339Nano, *s.RunAt)
+		if err != nil {
+			return nil, err
+		}
+		if runAt.After(t) {
+			return s.RunAt, nil
+		}
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("schedule has neither cron nor runAt")
+}
+
+const SCHEDULE_COLUMNS = `
+id, created_at, name, cron, run_at, spec, enabled, next_run, last_run, last_command_id
+`
+const INSERT_SCHEDULE_QUERY = `
+INSERT INTO schedule (` + SCHEDULE_COLUMNS + `)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+`
+const SELECT_SCHEDULE_QUERY = `
+SELECT ` + SCHEDULE_COLUMNS + `
+FROM schedule
+WHERE id = $1;
+`
+const LIST_SCHEDULE_QUERY = `
+SELECT ` + SCHEDULE_COLUMNS + `
+FROM schedule
+ORDER BY id DESC;
+`
+const UPDATE_SCHEDULE_QUERY = `
+UPDATE schedule
+SET name = ?, cron = ?, run_at = ?, spec = ?, enabled = ?, next_run = ?
+WHERE id = ?;
+`
+const UPDATE_SCHEDULE_RUN_QUERY = `
+UPDATE schedule
+SET enabled = ?, next_run = ?, last_run = ?, last_command_id = ?
+WHERE id = ?;
+`
+const DELETE_SCHEDULE_QUERY = `
+DELETE FROM schedule
+WHERE id = $1;
+`
+
+func scanSchedule(row rowScanner, s *Schedule) error {
+	var spec string
+	err := row.Scan(
+		&s.Id, &s.CreatedAt, &s.Name, &s.Cron, &s.RunAt, &spec,
+		&s.Enabled, &s.NextRun, &s.LastRun, &s.LastCommandId,
+	)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(spec), &s.Spec)
+}
+
+func (db *CockpitDB) NewSchedule(schedule *Schedule) (*Schedule, error) {
+	scheduleInfo := *schedule
+	scheduleInfo.Id = IdGen()
+	scheduleInfo.CreatedAt = FormatNow()
+
+	spec, err := json.Marshal(scheduleInfo.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(
+		INSERT_SCHEDULE_QUERY,
+		scheduleInfo.Id,
+		scheduleInfo.CreatedAt,
+		scheduleInfo.Name,
+		scheduleInfo.Cron,
+		scheduleInfo.RunAt,
+		string(spec),
+		scheduleInfo.Enabled,
+		scheduleInfo.NextRun,
+		scheduleInfo.LastRun,
+		scheduleInfo.LastCommandId,
+	)
+	if err != nil {
+		slog.Error("failed to insert new schedule", "error", err)
+		return nil, err
+	}
+
+	return &scheduleInfo, nil
+}
+
+func (db *CockpitDB) GetSchedule(id string) (*Schedule, error) {
+	var s Schedule
+
+	row := db.QueryRow(SELECT_SCHEDULE_QUERY, id)
+	if err := scanSchedule(row, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (db *CockpitDB) ListSchedules() ([]Schedule, error) {
+	rows, err := db.Query(LIST_SCHEDULE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		var s Schedule
+		err := scanSchedule(rows, &s)
+		if err != nil {
+			slog.Error("ListSchedules", "error", err)
+			continue
+		}
+
+		schedules = append(schedules, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return schedules, err
+	}
+	return schedules, nil
+}
+
+// write the user editable fields and the recomputed next run
+func (db *CockpitDB) UpdateSchedule(schedule *Schedule) error {
+	spec, err := json.Marshal(schedule.Spec)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		UPDATE_SCHEDULE_QUERY,
+		schedule.Name,
+		schedule.Cron,
+		schedule.RunAt,
+		string(spec),
+		schedule.Enabled,
+		schedule.NextRun,
+		schedule.Id,
+	)
+	if err != nil {
+		slog.Error("failed to update schedule", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+// write the outcome of the schedule firing
+func (db *CockpitDB) UpdateScheduleRun(schedule *Schedule) error {
+	_, err := db.Exec(
+		UPDATE_SCHEDULE_RUN_QUERY,
+		schedule.Enabled,
+		schedule.NextRun,
+		schedule.LastRun,
+		schedule.LastCommandId,
+		schedule.Id,
+	)
+	if err != nil {
+		slog.Error("failed to update schedule run", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (db *CockpitDB) DeleteSchedule(id string) error {
+	result, err := db.Exec(DELETE_SCHEDULE_QUERY, id)
+	if err != nil {
+		slog.Error("failed to delete schedule", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+// longest the scheduler sleeps before looking at the schedules again
+const SCHEDULER_MAX_SLEEP = 1 * time.Minute
+
+// Fires schedules when their next run is due
+type Scheduler struct {
+	DB         DB
+	Dispatcher *Dispatcher
+	kick       chan struct{}
+}
+
+func NewScheduler(db DB, dispatcher *Dispatcher) *Scheduler {
+	return &Scheduler{
+		DB:         db,
+		Dispatcher: dispatcher,
+		kick:       make(chan struct{}, 1),
+	}
+}
+
+// fire due schedules and sleep until the next one, blocks forever.
+// schedules missed while the server was down fire once on startup
+func (s *Scheduler) Start() {
+	for {
+		sleep := s.FireDue(time.Now())
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+		case <-s.kick:
+			timer.Stop()
+		}
+	}
+}
+
+// wake the scheduler after schedules changed
+func (s *Scheduler) Kick() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// fire every schedule due at `now`, returns how long until the next one
+func (s *Scheduler) FireDue(now time.Time) time.Duration {
+	sleep := SCHEDULER_MAX_SLEEP
+
+	schedules, err := s.DB.ListSchedules()
+	if err != nil {
+		slog.Error("Scheduler.FireDue db.ListSchedules", "error", err)
+		return sleep
+	}
+
+	for i := range schedules {
+		schedule := &schedules[i]
+		if !schedule.Enabled || schedule.NextRun == nil {
+			continue
+		}
+
+		nextRun, err := time.Parse(time.RFC3339Nano, *schedule.NextRun)
+		if err != nil {
+			slog.Error("Scheduler.FireDue invalid next run", "id", schedule.Id, "error", err)
+			continue
+		}
+
+		if !nextRun.After(now) {
+			s.Fire(schedule, now)
+			if schedule.NextRun == nil {
+				continue
+			}
+			nextRun, _ = time.Parse(time.RFC3339Nano, *schedule.NextRun)
+		}
+
+		if until := nextRun.Sub(now); until < sleep {
+			sleep = until
+		}
+	}
+	return sleep
+}
+
+// start the schedule's command and advance it to its next run
+func (s *Scheduler) Fire(schedule *Schedule, now time.Time) {
+	lastRun := now.UTC().Format(time.RFC3339Nano)
+	schedule.LastRun = &lastRun
+
+	command, err := schedule.Spec.ToCommand()
+	if err == nil {
+		command, err = s.Dispatcher.Submit(command)
+	}
+	if command != nil {
+		schedule.LastCommandId = &command.Id
+	}
+	if err != nil {
+		slog.Error("Scheduler.Fire", "schedule", schedule.Id, "error", err)
+	}
+
+	nextRun, err := schedule.NextAfter(now)
+	if err != nil {
+		slog.Error("Scheduler.Fire schedule.NextAfter", "schedule", schedule.Id, "error", err)
+	}
+	schedule.NextRun = nextRun
+	if nextRun == nil {
+		schedule.Enabled = false
+	}
+
+	s.DB.UpdateScheduleRun(schedule)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SaveSchedule struct {
+	Name string `json:"name"`
+	// cron expression like `0 3 * * *`, exclusive with runAt
+	Cron string `json:"cron"`
+	// RFC3339 timestamp of a one-off run, exclusive with cron
+	RunAt string     `json:"runAt"`
+	Spec  NewCommand `json:"spec"`
+	// defaults to true
+	Enabled *bool `json:"enabled"`
+}
+
+// validate the request and apply it to `schedule`, computing its next run
+func (s *SaveSchedule) Apply(schedule *Schedule) error {
+	if (len(s.Cron) > 0) == (len(s.RunAt) > 0) {
+		return fmt.Errorf("exactly one of cron and runAt is required")
+	}
+
+	schedule.Name = s.Name
+	schedule.Cron = s.Cron
+	schedule.RunAt = nil
+	if len(s.Cron) > 0 {
+		if _, err := ParseCron(s.Cron); err != nil {
+			return err
+		}
+	} else {
+		runAt, err := time.Parse(time.RFC3339Nano, s.RunAt)
+		if err != nil {
+			return fmt.Errorf("invalid runAt: %w", err)
+		}
+		formatted := runAt.UTC().Format(time.RFC3339Nano)
+		schedule.RunAt = &formatted
+	}
+
+	if len(s.Spec.Deadline) > 0 {
+		return fmt.Errorf("scheduled commands cannot have a deadline, use timeout")
+	}
+	if _, err := s.Spec.ToCommand(); err != nil {
+		return err
+	}
+	schedule.Spec = s.Spec
+
+	schedule.Enabled = s.Enabled == nil || *s.Enabled
+	nextRun, err := schedule.NextAfter(time.Now())
+	if err != nil {
+		return err
+	}
+	if nextRun == nil {
+		return fmt.Errorf("schedule will never run")
+	}
+	schedule.NextRun = nextRun
+
+	return nil
+}
+
+func NewScheduleHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	saveSchedule := new(SaveSchedule)
+	if err := cc.Bind(saveSchedule); err != nil {
+		slog.Error("NewScheduleHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	schedule := new(Schedule)
+	if err := saveSchedule.Apply(schedule); err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	schedule, err := cc.DB.NewSchedule(schedule)
+	if err != nil {
+		slog.Error("NewScheduleHandler cc.DB.NewSchedule", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	cc.Scheduler.Kick()
+
+	return cc.JSON(http.StatusCreated, schedule)
+}
+
+func ListScheduleHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	schedules, err := cc.DB.ListSchedules()
+	if err != nil {
+		slog.Error("ListScheduleHandler cc.DB.ListSchedules", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, schedules)
+}
+
+func GetScheduleHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	schedule, err := cc.DB.GetSchedule(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "schedule not found")
+	} else if err != nil {
+		slog.Error("GetScheduleHandler cc.DB.GetSchedule", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, schedule)
+}
+
+func UpdateScheduleHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	saveSchedule := new(SaveSchedule)
+	if err := cc.Bind(saveSchedule); err != nil {
+		slog.Error("UpdateScheduleHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	schedule, err := cc.DB.GetSchedule(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "schedule not found")
+	} else if err != nil {
+		slog.Error("UpdateScheduleHandler cc.DB.GetSchedule", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	if err := saveSchedule.Apply(schedule); err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := cc.DB.UpdateSchedule(schedule); err != nil {
+		slog.Error("UpdateScheduleHandler cc.DB.UpdateSchedule", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	cc.Scheduler.Kick()
+
+	return cc.JSON(http.StatusOK, schedule)
+}
+
+func DeleteScheduleHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	err := cc.DB.DeleteSchedule(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "schedule not found")
+	} else if err != nil {
+		slog.Error("DeleteScheduleHandler cc.DB.DeleteSchedule", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	cc.Scheduler.Kick()
+
+	return cc.NoContent(http.StatusOK)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	dispatcher := NewDispatcher(db, runner, bus)
+	scheduler := NewScheduler(db, dispatcher)
+
+	now := time.Now()
+	missed := now.Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	schedule, err := db.NewSchedule(&Schedule{
+		Name:    "nightly",
+		Cron:    "0 3 * * *",
+		Spec:    NewCommand{Command: "true"},
+		Enabled: true,
+		NextRun: &missed,
+	})
+	if err != nil {
+		t.Fatalf("NewSchedule error: %s\n", err)
+	}
+
+	sleep := scheduler.FireDue(now)
+	if sleep <= 0 || sleep > SCHEDULER_MAX_SLEEP {
+		t.Errorf("unexpected sleep %s\n", sleep)
+	}
+
+	fired, err := db.GetSchedule(schedule.Id)
+	if err != nil {
+		t.Fatalf("GetSchedule error: %s\n", err)
+	}
+	if fired.LastCommandId == nil || fired.LastRun == nil {
+		t.Fatalf("schedule did not fire: %+v\n", fired)
+	}
+	if fired.NextRun == nil || *fired.NextRun <= missed {
+		t.Errorf("next run not advanced: %v\n", fired.NextRun)
+	}
+
+	command, err := db.GetCommand(*fired.LastCommandId)
+	if err != nil {
+		t.Fatalf("GetCommand error: %s\n", err)
+	}
+	if command.Command != "true" {
+		t.Errorf("unexpected command %s\n", command.Command)
+	}
+
+	if err := db.DeleteSchedule(schedule.Id); err != nil {
+		t.Errorf("DeleteSchedule error: %s\n", err)
+	}
+}
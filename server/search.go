@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+type SearchKind string
+
+const (
+	SEARCH_COMMAND SearchKind = "command"
+	SEARCH_LOG     SearchKind = "log"
+)
+
+// marks around the matched terms in snippets, char(2) and char(3) in the
+// queries, split into SnippetParts before they leave the server
+const SNIPPET_OPEN = "\x02"
+const SNIPPET_CLOSE = "\x03"
+
+type SearchQuery struct {
+	// words to find, double quoted text is matched as a phrase
+	Text string
+	// statuses of the commands to search, all when empty
+	Statuses []CommandStatus
+	// only logs of this fd, commands never match
+	FD        *LogFD
+	CommandId string
+	// created within [Since, Until)
+	Since *time.Time
+	Until *time.Time
+	// id of the last result of the previous page
+	Before string
+	Limit  uint
+}
+
+// Command line or log line matching a search, newest first
+type SearchResult struct {
+	Kind SearchKind `json:"kind"`
+	// id of the command or log
+	Id        string        `json:"id"`
+	CommandId string        `json:"commandId"`
+	CreatedAt string        `json:"createdAt"`
+	Command   string        `json:"command"`
+	Status    CommandStatus `json:"status"`
+	// only set for logs
+	FD      *LogFD        `json:"fd"`
+	Snippet []SnippetPart `json:"snippet"`
+}
+
+// Piece of a snippet, `Match` is set on the matched terms
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+// External content indexes over command.command and log.content kept up to
+// date by triggers. They refer to rows by rowid which a VACUUM may change,
+// so the indexes are rebuilt after every vacuum.
+func migrateSearch(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE VIRTUAL TABLE command_fts USING fts5(command, content='command', content_rowid='rowid');
+CREATE TRIGGER command_fts_insert AFTER INSERT ON command BEGIN
+    INSERT INTO command_fts (rowid, command) VALUES (new.rowid, new.command);
+END;
+CREATE TRIGGER command_fts_delete AFTER DELETE ON command BEGIN
+    INSERT INTO command_fts (command_fts, rowid, command) VALUES ('delete', old.rowid, old.command);
+END;
+CREATE TRIGGER command_fts_update AFTER UPDATE OF command ON command BEGIN
+    INSERT INTO command_fts (command_fts, rowid, command) VALUES ('delete', old.rowid, old.command);
+    INSERT INTO command_fts (rowid, command) VALUES (new.rowid, new.command);
+END;
+
+CREATE VIRTUAL TABLE log_fts USING fts5(content, content='log', content_rowid='rowid');
+CREATE TRIGGER log_fts_insert AFTER INSERT ON log BEGIN
+    INSERT INTO log_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+CREATE TRIGGER log_fts_delete AFTER DELETE ON log BEGIN
+    INSERT INTO log_fts (log_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+END;
+CREATE TRIGGER log_fts_update AFTER UPDATE OF content ON log BEGIN
+    INSERT INTO log_fts (log_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+    INSERT INTO log_fts (rowid, content) VALUES (new.rowid, new.content);
+END;
+`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(REBUILD_SEARCH_QUERY)
+	return err
+}
+
+const REBUILD_SEARCH_QUERY = `
+INSERT INTO command_fts (command_fts) VALUES ('rebuild');
+INSERT INTO log_fts (log_fts) VALUES ('rebuild');
+`
+
+// $1 match, $2 statuses as a json array, $3 command id, $4 lowest id, $5 id after the last one
+const SEARCH_COMMAND_QUERY = `
+SELECT c.id, c.id, c.created_at, c.command, c.status,
+snippet(command_fts, 0, char(2), char(3), '…', 16)
+FROM command_fts
+JOIN command c ON c.rowid = command_fts.rowid
+WHERE command_fts MATCH $1
+AND ($2 = '[]' OR c.status IN (SELECT value FROM json_each($2)))
+AND ($3 = '' OR c.id = $3)
+AND c.id >= $4 AND c.id < $5
+ORDER BY c.id DESC
+LIMIT $6;
+`
+
+// same as SEARCH_COMMAND_QUERY with $6 the fd, if any, and $7 the limit
+const SEARCH_LOG_QUERY = `
+SELECT l.id, l.command_id, l.created_at, c.command, c.status, l.fd,
+snippet(log_fts, 0, char(2), char(3), '…', 16)
+FROM log_fts
+JOIN log l ON l.rowid = log_fts.rowid
+JOIN command c ON c.id = l.command_id
+WHERE log_fts MATCH $1
+AND ($2 = '[]' OR c.status IN (SELECT value FROM json_each($2)))
+AND ($3 = '' OR l.command_id = $3)
+AND l.id >= $4 AND l.id < $5
+AND ($6 IS NULL OR l.fd = $6)
+ORDER BY l.id DESC
+LIMIT $7;
+`
+
+// FTS5 query matching every word of `text`, double quoted parts are
+// phrases. Operators and column filters of the FTS5 syntax are taken
+// literally, so any input is a valid query.
+func SearchMatch(text string) string {
+	terms := []string{}
+	for i, part := range strings.Split(text, `"`) {
+		// parts at odd positions were inside quotes
+		if i%2 == 1 {
+			if len(strings.TrimSpace(part)) > 0 {
+				terms = append(terms, part)
+			}
+			continue
+		}
+		terms = append(terms, strings.Fields(part)...)
+	}
+
+	for i, term := range terms {
+		terms[i] = `"` + term + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+// split a snippet marked with SNIPPET_OPEN and SNIPPET_CLOSE into parts
+func SplitSnippet(snippet string) []SnippetPart {
+	parts := []SnippetPart{}
+	for len(snippet) > 0 {
+		open := strings.Index(snippet, SNIPPET_OPEN)
+		if open < 0 {
+			parts = append(parts, SnippetPart{Text: snippet})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, SnippetPart{Text: snippet[:open]})
+		}
+		snippet = snippet[open+len(SNIPPET_OPEN):]
+
+		end := strings.Index(snippet, SNIPPET_CLOSE)
+		if end < 0 {
+			end = len(snippet)
+		}
+		parts = append(parts, SnippetPart{Text: snippet[:end], Match: true})
+		snippet = strings.TrimPrefix(snippet[end:], SNIPPET_CLOSE)
+	}
+	return parts
+}
+
+// smallest id of a row created at `t`
+func timeId(t time.Time) string {
+	var id ulid.ULID
+	if err := id.SetTime(ulid.Timestamp(t)); err != nil {
+		return MAX_ID
+	}
+	return id.String()
+}
+
+func (db *CockpitDB) Search(query *SearchQuery) ([]SearchResult, error) {
+	match := SearchMatch(query.Text)
+	statuses, err := json.Marshal(query.Statuses)
+	if err != nil {
+		return nil, err
+	}
+	if query.Statuses == nil {
+		statuses = []byte("[]")
+	}
+
+	lowest := ""
+	if query.Since != nil {
+		lowest = timeId(*query.Since)
+	}
+	before := MAX_ID
+	if len(query.Before) > 0 {
+		before = query.Before
+	}
+	if query.Until != nil {
+		before = min(before, timeId(*query.Until))
+	}
+
+	results := []SearchResult{}
+	if query.FD == nil {
+		rows, err := db.Query(SEARCH_COMMAND_QUERY, match, string(statuses), query.CommandId, lowest, before, query.Limit)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r := SearchResult{Kind: SEARCH_COMMAND}
+			var snippet string
+			if err := rows.Scan(&r.Id, &r.CommandId, &r.CreatedAt, &r.Command, &r.Status, &snippet); err != nil {
+				slog.Error("Search", "error", err)
+				continue
+			}
+			r.Snippet = SplitSnippet(snippet)
+			results = append(results, r)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Query(SEARCH_LOG_QUERY, match, string(statuses), query.CommandId, lowest, before, query.FD, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := SearchResult{Kind: SEARCH_LOG}
+		var snippet string
+		var fd LogFD
+		if err := rows.Scan(&r.Id, &r.CommandId, &r.CreatedAt, &r.Command, &r.Status, &fd, &snippet); err != nil {
+			slog.Error("Search", "error", err)
+			continue
+		}
+		r.FD = &fd
+		r.Snippet = SplitSnippet(snippet)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// both lists are newest first, the page is the newest of either
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		return strings.Compare(b.Id, a.Id)
+	})
+	if uint(len(results)) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
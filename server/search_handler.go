@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// results per page when the request has no limit
+const SEARCH_DEFAULT_LIMIT = 50
+
+// `q` words to find, `status` any number of times, `fd`, `command` id,
+// `since` and `until` as RFC 3339 times, `before` the id of the last
+// result of the previous page and `limit`
+func SearchHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	query := &SearchQuery{
+		Text:      cc.QueryParam("q"),
+		CommandId: cc.QueryParam("command"),
+		Before:    cc.QueryParam("before"),
+		Limit:     SEARCH_DEFAULT_LIMIT,
+	}
+	if len(SearchMatch(query.Text)) == 0 {
+		return cc.String(http.StatusBadRequest, "empty q param")
+	}
+
+	for _, status := range cc.QueryParams()["status"] {
+		if !slices.Contains(COMMAND_STATUSES, CommandStatus(status)) {
+			return cc.String(http.StatusBadRequest, "invalid status param")
+		}
+		query.Statuses = append(query.Statuses, CommandStatus(status))
+	}
+
+	if fdParam := cc.QueryParam("fd"); len(fdParam) > 0 {
+		fd, err := strconv.Atoi(fdParam)
+		if err != nil {
+			return cc.String(http.StatusBadRequest, "invalid fd param")
+		}
+		logFD := LogFD(fd)
+		query.FD = &logFD
+	}
+
+	var err error
+	if query.Since, err = timeParam(cc, "since"); err != nil {
+		return cc.String(http.StatusBadRequest, "invalid since param")
+	}
+	if query.Until, err = timeParam(cc, "until"); err != nil {
+		return cc.String(http.StatusBadRequest, "invalid until param")
+	}
+
+	if limitParam := cc.QueryParam("limit"); len(limitParam) > 0 {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil {
+			return cc.String(http.StatusBadRequest, "invalid limit param")
+		}
+		if limit < 0 {
+			return cc.String(http.StatusBadRequest, "negative limit param")
+		}
+		query.Limit = uint(limit)
+	}
+
+	results, err := cc.DB.Search(query)
+	if err != nil {
+		slog.Error("SearchHandler cc.DB.Search", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, results)
+}
+
+// nil if the query param `name` is missing
+func timeParam(cc *CockpitContext, name string) (*time.Time, error) {
+	param := cc.QueryParam(name)
+	if len(param) == 0 {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, param)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
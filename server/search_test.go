@@ -0,0 +1,178 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSearchMatch(t *testing.T) {
+	cases := map[string]string{
+		`connection reset`:        `"connection" "reset"`,
+		`"connection reset" peer`: `"connection reset" "peer"`,
+		`a OR b`:                  `"a" "OR" "b"`,
+		`NEAR(a b) col:x`:         `"NEAR(a" "b)" "col:x"`,
+		`"unterminated phrase`:    `"unterminated phrase"`,
+		`  "" `:                   ``,
+	}
+	for text, expected := range cases {
+		if match := SearchMatch(text); match != expected {
+			t.Errorf("SearchMatch(%q) = %q, expected %q\n", text, match, expected)
+		}
+	}
+}
+
+func TestSplitSnippet(t *testing.T) {
+	parts := SplitSnippet("…read: \x02connection\x03 \x02reset\x03 by peer")
+	expected := []SnippetPart{
+		{Text: "…read: "},
+		{Text: "connection", Match: true},
+		{Text: " "},
+		{Text: "reset", Match: true},
+		{Text: " by peer"},
+	}
+	if !slices.Equal(parts, expected) {
+		t.Errorf("unexpected parts %v\n", parts)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dsn := "file:" + t.TempDir() + "/search.db"
+	db, err := NewDB(dsn, NewEventBus())
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	defer db.(*CockpitDB).Close()
+
+	newCommand := func(line string, status CommandStatus) *Command {
+		command, err := db.NewCommand(&Command{Command: line})
+		if err != nil {
+			t.Fatalf("NewCommand error: %s\n", err)
+		}
+		if err := db.UpdateStatus(command.Id, status); err != nil {
+			t.Fatalf("UpdateStatus error: %s\n", err)
+		}
+		return command
+	}
+	addLog := func(command *Command, content string, fd LogFD) *Log {
+		log := &Log{Id: IdGen(), CommandId: command.Id, CreatedAt: FormatNow(), Content: content, FD: fd}
+		if err := db.AddLog(log); err != nil {
+			t.Fatalf("AddLog error: %s\n", err)
+		}
+		return log
+	}
+	search := func(query SearchQuery) []SearchResult {
+		if query.Limit == 0 {
+			query.Limit = 10
+		}
+		results, err := db.Search(&query)
+		if err != nil {
+			t.Fatalf("Search error: %s\n", err)
+		}
+		return results
+	}
+	ids := func(results []SearchResult) []string {
+		ids := []string{}
+		for _, r := range results {
+			ids = append(ids, r.Id)
+		}
+		return ids
+	}
+
+	curl := newCommand("curl https://example.com", COMMAND_ERROR)
+	reset := addLog(curl, "curl: (56) Recv failure: Connection reset by peer", LOG_STDERR)
+	addLog(curl, "retrying connection", LOG_STDOUT)
+	wget := newCommand("wget https://example.com", COMMAND_EXITED)
+	addLog(wget, "connection established", LOG_STDOUT)
+	later := addLog(wget, "Connection reset, reconnecting", LOG_STDOUT)
+
+	t.Run("phrase", func(t *testing.T) {
+		results := search(SearchQuery{Text: `"connection reset"`})
+		if !slices.Equal(ids(results), []string{later.Id, reset.Id}) {
+			t.Fatalf("unexpected results %v\n", results)
+		}
+		r := results[1]
+		if r.Kind != SEARCH_LOG || r.CommandId != curl.Id || r.Command != curl.Command || *r.FD != LOG_STDERR {
+			t.Errorf("unexpected result %+v\n", r)
+		}
+		if !slices.ContainsFunc(r.Snippet, func(p SnippetPart) bool { return p.Match && p.Text == "Connection reset" }) {
+			t.Errorf("match not highlighted in %v\n", r.Snippet)
+		}
+	})
+
+	t.Run("commands", func(t *testing.T) {
+		results := search(SearchQuery{Text: "wget"})
+		if len(results) != 1 || results[0].Kind != SEARCH_COMMAND || results[0].Id != wget.Id {
+			t.Errorf("unexpected results %v\n", results)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		results := search(SearchQuery{Text: "connection", Statuses: []CommandStatus{COMMAND_ERROR}})
+		if len(results) != 2 || results[0].CommandId != curl.Id || results[1].CommandId != curl.Id {
+			t.Errorf("status filter: unexpected results %v\n", results)
+		}
+
+		fd := LOG_STDERR
+		results = search(SearchQuery{Text: "connection", FD: &fd})
+		if !slices.Equal(ids(results), []string{reset.Id}) {
+			t.Errorf("fd filter: unexpected results %v\n", results)
+		}
+
+		results = search(SearchQuery{Text: "example", CommandId: wget.Id})
+		if !slices.Equal(ids(results), []string{wget.Id}) {
+			t.Errorf("command filter: unexpected results %v\n", results)
+		}
+
+		future := time.Now().Add(time.Hour)
+		if results := search(SearchQuery{Text: "connection", Since: &future}); len(results) != 0 {
+			t.Errorf("since filter: unexpected results %v\n", results)
+		}
+		past := time.Now().Add(-time.Hour)
+		if results := search(SearchQuery{Text: "connection", Until: &past}); len(results) != 0 {
+			t.Errorf("until filter: unexpected results %v\n", results)
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		all := ids(search(SearchQuery{Text: "connection"}))
+		if len(all) != 4 {
+			t.Fatalf("expected 4 results, got %v\n", all)
+		}
+		paged := []string{}
+		before := ""
+		for {
+			page := search(SearchQuery{Text: "connection", Before: before, Limit: 3})
+			if len(page) == 0 {
+				break
+			}
+			paged = append(paged, ids(page)...)
+			before = page[len(page)-1].Id
+		}
+		if !slices.Equal(paged, all) {
+			t.Errorf("pages %v differ from %v\n", paged, all)
+		}
+	})
+
+	t.Run("index follows changes", func(t *testing.T) {
+		// a partial line completed later replaces its content
+		reset.Content = "Connection refused"
+		if err := db.AddLog(reset); err != nil {
+			t.Fatalf("AddLog error: %s\n", err)
+		}
+		if results := search(SearchQuery{Text: "refused"}); !slices.Equal(ids(results), []string{reset.Id}) {
+			t.Errorf("updated log not found %v\n", results)
+		}
+
+		if err := db.DeleteCommand(wget.Id); err != nil {
+			t.Fatalf("DeleteCommand error: %s\n", err)
+		}
+		if _, err := db.Vacuum(); err != nil {
+			t.Fatalf("Vacuum error: %s\n", err)
+		}
+		results := search(SearchQuery{Text: "connection"})
+		if len(results) != 2 || results[0].CommandId != curl.Id || results[1].CommandId != curl.Id {
+			t.Errorf("unexpected results after delete %v\n", results)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var SIGNALS = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGCONT": syscall.SIGCONT,
+	"SIGSTOP": syscall.SIGSTOP,
+}
+
+// signals a command may be stopped with before SIGKILL, the others would
+// pause it, resume it or kill it without a grace period
+var STOP_SIGNALS = []syscall.Signal{
+	syscall.SIGTERM,
+	syscall.SIGINT,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// Parse signal name like `SIGTERM`, `term` or a signal number like `15`
+func ParseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		for _, sig := range SIGNALS {
+			if int(sig) == n {
+				return sig, nil
+			}
+		}
+		return 0, fmt.Errorf("unsupported signal number %d", n)
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, found := SIGNALS[name]
+	if !found {
+		return 0, fmt.Errorf("unsupported signal %s", name)
+	}
+	return sig, nil
+}
+
+func SignalName(sig syscall.Signal) string {
+	for name, s := range SIGNALS {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type ParamType string
+
+const (
+	PARAM_STRING ParamType = "string"
+	PARAM_INT    ParamType = "int"
+	PARAM_FLOAT  ParamType = "float"
+	PARAM_BOOL   ParamType = "bool"
+	// non-empty string without newlines
+	PARAM_PATH ParamType = "path"
+)
+
+var PARAM_TYPES = []ParamType{PARAM_STRING, PARAM_INT, PARAM_FLOAT, PARAM_BOOL, PARAM_PATH}
+
+// Placeholder of a template like `{{crf:int=23}}`
+type TemplateParam struct {
+	Name string    `json:"name"`
+	Type ParamType `json:"type"`
+	// nil when the parameter is required
+	Default *string `json:"default"`
+}
+
+// `{{name}}`, `{{name:type}}`, `{{name=default}}` or `{{name:type=default}}`,
+// braces not matching it like `{{.Names}}` of `docker ps --format` stay as they are
+var PLACEHOLDER_REGEX = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)(?::([a-z]+))?(?:=([^}]*))?\s*\}\}`)
+
+// normalized form of `value`, fails if it is not of type `t`
+func (t ParamType) Normalize(value string) (string, error) {
+	switch t {
+	case PARAM_STRING:
+		return value, nil
+	case PARAM_INT:
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not an int", value)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case PARAM_FLOAT:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a float", value)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case PARAM_BOOL:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("%q is not a bool", value)
+		}
+		return strconv.FormatBool(b), nil
+	case PARAM_PATH:
+		if len(value) == 0 || strings.ContainsAny(value, "\n\x00") {
+			return "", fmt.Errorf("%q is not a path", value)
+		}
+		// would be taken as an option by most commands
+		if strings.HasPrefix(value, "-") {
+			return "", fmt.Errorf("path %q starts with -, prefix it with ./", value)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown type %s", t)
+}
+
+// Parameters of the template text in order of their first appearance.
+// A parameter may appear more than once with the same type.
+func ParseTemplate(text string) ([]TemplateParam, error) {
+	params := []TemplateParam{}
+	seen := map[string]int{}
+	for _, match := range PLACEHOLDER_REGEX.FindAllStringSubmatchIndex(text, -1) {
+		param := TemplateParam{Name: text[match[2]:match[3]], Type: PARAM_STRING}
+		if match[4] >= 0 {
+			param.Type = ParamType(text[match[4]:match[5]])
+			if !slices.Contains(PARAM_TYPES, param.Type) {
+				return nil, fmt.Errorf("parameter %s has unknown type %s", param.Name, param.Type)
+			}
+		}
+		if match[6] >= 0 {
+			value, err := param.Type.Normalize(text[match[6]:match[7]])
+			if err != nil {
+				return nil, fmt.Errorf("default of %s: %w", param.Name, err)
+			}
+			param.Default = &value
+		}
+
+		if i, found := seen[param.Name]; found {
+			prev := &params[i]
+			if prev.Type != param.Type {
+				return nil, fmt.Errorf("parameter %s is used as %s and %s", param.Name, prev.Type, param.Type)
+			}
+			if param.Default != nil {
+				if prev.Default != nil && *prev.Default != *param.Default {
+					return nil, fmt.Errorf("parameter %s has different defaults", param.Name)
+				}
+				prev.Default = param.Default
+			}
+			continue
+		}
+		seen[param.Name] = len(params)
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+// Fails if a placeholder of `text` is inside single or double quotes,
+// backticks, `$( )` or the body of a heredoc with an unquoted delimiter.
+// Values are quoted for the top level of the command line, inside of
+// those the quoting would not hold.
+func CheckPlaceholderQuotes(text string) error {
+	matches := PLACEHOLDER_REGEX.FindAllStringIndex(text, -1)
+	// quotes and substitutions open at the current position, innermost last
+	stack := []string{}
+	top := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1]
+	}
+	subshell := func(i int) bool {
+		return text[i] == '$' && i+1 < len(text) && text[i+1] == '('
+	}
+	// heredocs started on the current line, their bodies follow it
+	heredocs := []heredoc{}
+	// first placeholder in [start, end)
+	placeholder := func(start int, end int) string {
+		for _, match := range matches {
+			if match[0] >= start && match[0] < end {
+				return text[match[0]:match[1]]
+			}
+		}
+		return ""
+	}
+
+	for i := 0; i < len(text); i++ {
+		if len(matches) > 0 && i == matches[0][0] {
+			if len(stack) > 0 {
+				return fmt.Errorf("placeholder %s is inside %s, values are quoted already", text[i:matches[0][1]], stack[0])
+			}
+			i = matches[0][1] - 1
+			matches = matches[1:]
+			continue
+		}
+
+		c := text[i]
+		switch top() {
+		case "single quotes":
+			if c == '\'' {
+				stack = stack[:len(stack)-1]
+			}
+		case "double quotes":
+			switch {
+			case c == '\\':
+				i++
+			case c == '"':
+				stack = stack[:len(stack)-1]
+			case c == '`':
+				stack = append(stack, "backticks")
+			case subshell(i):
+				stack = append(stack, "$( )")
+				i++
+			}
+		case "backticks":
+			switch {
+			case c == '\\':
+				i++
+			case c == '`':
+				stack = stack[:len(stack)-1]
+			case c == '\'':
+				stack = append(stack, "single quotes")
+			case c == '"':
+				stack = append(stack, "double quotes")
+			case subshell(i):
+				stack = append(stack, "$( )")
+				i++
+			}
+		default:
+			// top level or inside `$( )`, where parens nest
+			switch {
+			case c == '\\':
+				i++
+			case c == '\'':
+				stack = append(stack, "single quotes")
+			case c == '"':
+				stack = append(stack, "double quotes")
+			case c == '`':
+				stack = append(stack, "backticks")
+			case subshell(i):
+				stack = append(stack, "$( )")
+				i++
+			case c == '(' && len(stack) > 0:
+				stack = append(stack, "( )")
+			case c == ')' && len(stack) > 0:
+				stack = stack[:len(stack)-1]
+			case strings.HasPrefix(text[i:], "<<<"):
+				// here string, a word like any other
+				i += 2
+			case strings.HasPrefix(text[i:], "<<") && top() != "( )":
+				doc, end := readHeredoc(text, i)
+				if p := placeholder(i, end); len(p) > 0 {
+					return fmt.Errorf("placeholder %s is a heredoc delimiter", p)
+				}
+				if len(doc.delimiter) > 0 {
+					heredocs = append(heredocs, doc)
+				}
+				i = end - 1
+			case c == '\n' && len(heredocs) > 0:
+				start := i + 1
+				for _, doc := range heredocs {
+					end := doc.bodyEnd(text, start)
+					// bodies of quoted delimiters are taken literally
+					if p := placeholder(start, end); len(p) > 0 && !doc.quoted {
+						return fmt.Errorf("placeholder %s is inside a heredoc, quote its delimiter like <<'%s'", p, doc.delimiter)
+					}
+					start = end
+				}
+				heredocs = heredocs[:0]
+				for len(matches) > 0 && matches[0][0] < start {
+					matches = matches[1:]
+				}
+				i = start - 1
+			}
+		}
+	}
+	return nil
+}
+
+// `<<WORD` or `<<-WORD` redirect of a command line
+type heredoc struct {
+	delimiter string
+	// any part of the word was quoted, the body is not expanded
+	quoted bool
+	// `<<-` strips leading tabs of the body lines
+	stripTabs bool
+}
+
+// the heredoc whose `<<` is at `start` and the end of its delimiter word
+func readHeredoc(text string, start int) (heredoc, int) {
+	var doc heredoc
+	i := start + 2
+	if i < len(text) && text[i] == '-' {
+		doc.stripTabs = true
+		i++
+	}
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+
+	var word strings.Builder
+	quote := byte(0)
+	for ; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+			continue
+		}
+		if c == '\'' || c == '"' {
+			quote = c
+			doc.quoted = true
+			continue
+		}
+		if c == '\\' && i+1 < len(text) {
+			doc.quoted = true
+			i++
+			word.WriteByte(text[i])
+			continue
+		}
+		if strings.IndexByte(" \t\n;&|<>()", c) >= 0 {
+			break
+		}
+		word.WriteByte(c)
+	}
+	doc.delimiter = word.String()
+	return doc, i
+}
+
+// end of the body starting at `start` after its delimiter line,
+// the end of `text` if the delimiter never comes
+func (doc heredoc) bodyEnd(text string, start int) int {
+	for start < len(text) {
+		end := strings.IndexByte(text[start:], '\n')
+		next := start + end + 1
+		if end < 0 {
+			end = len(text) - start
+			next = len(text)
+		}
+		line := text[start : start+end]
+		if doc.stripTabs {
+			line = strings.TrimLeft(line, "\t")
+		}
+		if line == doc.delimiter {
+			return next
+		}
+		start = next
+	}
+	return len(text)
+}
+
+// shells whose quoting ShellQuote follows, templates run in nothing else
+var TEMPLATE_SHELLS = []string{"sh", "bash"}
+
+// Fails unless the template runs in one of TEMPLATE_SHELLS, the quoting
+// of its values means nothing to other programs
+func CheckTemplateExec(spec *ExecSpec) error {
+	if spec == nil {
+		return nil
+	}
+	program := ""
+	switch spec.Mode {
+	case EXEC_ARGV:
+		return fmt.Errorf("templates cannot run in argv mode")
+	case EXEC_SCRIPT:
+		if len(spec.Interpreter) > 0 {
+			program = spec.Interpreter[0]
+		}
+	default:
+		program = spec.Shell
+	}
+	if len(program) > 0 && !slices.Contains(TEMPLATE_SHELLS, filepath.Base(program)) {
+		return fmt.Errorf("templates only run in sh or bash, not %s", program)
+	}
+	return nil
+}
+
+// Replace the placeholders of `text` with the shell quoted `values`,
+// falling back to the defaults. Numbers and booleans in `values` are
+// accepted for the parameters of those types.
+func RenderTemplate(text string, values map[string]any) (string, error) {
+	params, err := ParseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	rendered := map[string]string{}
+	for _, param := range params {
+		value, found := values[param.Name]
+		if !found || value == nil {
+			if param.Default == nil {
+				return "", fmt.Errorf("missing parameter %s", param.Name)
+			}
+			rendered[param.Name] = *param.Default
+			continue
+		}
+
+		var raw string
+		switch v := value.(type) {
+		case string:
+			raw = v
+		case float64:
+			raw = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			raw = strconv.FormatBool(v)
+		default:
+			return "", fmt.Errorf("parameter %s has unsupported value %v", param.Name, value)
+		}
+		normalized, err := param.Type.Normalize(raw)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s: %w", param.Name, err)
+		}
+		rendered[param.Name] = normalized
+	}
+
+	for name := range values {
+		if _, found := rendered[name]; !found {
+			return "", fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+
+	return PLACEHOLDER_REGEX.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := PLACEHOLDER_REGEX.FindStringSubmatch(placeholder)[1]
+		return ShellQuote(rendered[name])
+	}), nil
+}
+
+// Saved command line with placeholders, run with parameters filled in
+type Template struct {
+	Id          string `json:"id"`
+	CreatedAt   string `json:"createdAt"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// command line with placeholders like `{{input:path}}`, values are
+	// quoted when they are filled in so placeholders must not be quoted
+	Command string `json:"command"`
+	// options of the commands run from the template, its command is ignored
+	Spec NewCommand `json:"spec"`
+	// placeholders of `Command`, derived when the template is read
+	Params []TemplateParam `json:"params"`
+}
+
+const TEMPLATE_COLUMNS = `
+id, created_at, name, description, command, spec
+`
+const INSERT_TEMPLATE_QUERY = `
+INSERT INTO template (` + TEMPLATE_COLUMNS + `)
+VALUES (?, ?, ?, ?, ?, ?);
+`
+const SELECT_TEMPLATE_QUERY = `
+SELECT ` + TEMPLATE_COLUMNS + `
+FROM template
+WHERE id = $1;
+`
+const LIST_TEMPLATE_QUERY = `
+SELECT ` + TEMPLATE_COLUMNS + `
+FROM template
+ORDER BY name, id;
+`
+const UPDATE_TEMPLATE_QUERY = `
+UPDATE template
+SET name = ?, description = ?, command = ?, spec = ?
+WHERE id = ?;
+`
+const DELETE_TEMPLATE_QUERY = `
+DELETE FROM template
+WHERE id = $1;
+`
+
+func scanTemplate(row rowScanner, t *Template) error {
+	var spec string
+	err := row.Scan(&t.Id, &t.CreatedAt, &t.Name, &t.Description, &t.Command, &spec)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(spec), &t.Spec); err != nil {
+		return err
+	}
+	t.Params, err = ParseTemplate(t.Command)
+	return err
+}
+
+func (db *CockpitDB) NewTemplate(template *Template) (*Template, error) {
+	templateInfo := *template
+	templateInfo.Id = IdGen()
+	templateInfo.CreatedAt = FormatNow()
+
+	spec, err := json.Marshal(templateInfo.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(
+		INSERT_TEMPLATE_QUERY,
+		templateInfo.Id,
+		templateInfo.CreatedAt,
+		templateInfo.Name,
+		templateInfo.Description,
+		templateInfo.Command,
+		string(spec),
+	)
+	if err != nil {
+		slog.Error("failed to insert new template", "error", err)
+		return nil, err
+	}
+
+	return &templateInfo, nil
+}
+
+func (db *CockpitDB) GetTemplate(id string) (*Template, error) {
+	var t Template
+
+	row := db.QueryRow(SELECT_TEMPLATE_QUERY, id)
+	if err := scanTemplate(row, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (db *CockpitDB) ListTemplates() ([]Template, error) {
+	rows, err := db.Query(LIST_TEMPLATE_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []Template{}
+	for rows.Next() {
+		var t Template
+		err := scanTemplate(rows, &t)
+		if err != nil {
+			slog.Error("ListTemplates", "error", err)
+			continue
+		}
+
+		templates = append(templates, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		return templates, err
+	}
+	return templates, nil
+}
+
+func (db *CockpitDB) UpdateTemplate(template *Template) error {
+	spec, err := json.Marshal(template.Spec)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		UPDATE_TEMPLATE_QUERY,
+		template.Name,
+		template.Description,
+		template.Command,
+		string(spec),
+		template.Id,
+	)
+	if err != nil {
+		slog.Error("failed to update template", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+func (db *CockpitDB) DeleteTemplate(id string) error {
+	result, err := db.Exec(DELETE_TEMPLATE_QUERY, id)
+	if err != nil {
+		slog.Error("failed to delete template", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
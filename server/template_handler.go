@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SaveTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// command line with placeholders like `{{crf:int=23}}`
+	Command string `json:"command"`
+	// options of the commands run from the template, its command is ignored
+	Spec NewCommand `json:"spec"`
+}
+
+// validate the request and apply it to `template`
+func (s *SaveTemplate) Apply(template *Template) error {
+	if len(s.Name) == 0 {
+		return fmt.Errorf("template has no name")
+	}
+	if len(s.Command) == 0 {
+		return fmt.Errorf("template has no command")
+	}
+	params, err := ParseTemplate(s.Command)
+	if err != nil {
+		return err
+	}
+	if err := CheckPlaceholderQuotes(s.Command); err != nil {
+		return err
+	}
+	if err := CheckTemplateExec(s.Spec.Exec); err != nil {
+		return err
+	}
+	if len(s.Spec.Deadline) > 0 {
+		return fmt.Errorf("templates cannot have a deadline, use timeout")
+	}
+	spec := s.Spec
+	spec.Command = s.Command
+	if _, err := spec.ToCommand(); err != nil {
+		return err
+	}
+	spec.Command = ""
+
+	template.Name = s.Name
+	template.Description = s.Description
+	template.Command = s.Command
+	template.Spec = spec
+	template.Params = params
+	return nil
+}
+
+func NewTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	saveTemplate := new(SaveTemplate)
+	if err := cc.Bind(saveTemplate); err != nil {
+		slog.Error("NewTemplateHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	template := new(Template)
+	if err := saveTemplate.Apply(template); err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	template, err := cc.DB.NewTemplate(template)
+	if err != nil {
+		slog.Error("NewTemplateHandler cc.DB.NewTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.JSON(http.StatusCreated, template)
+}
+
+func ListTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	templates, err := cc.DB.ListTemplates()
+	if err != nil {
+		slog.Error("ListTemplateHandler cc.DB.ListTemplates", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, templates)
+}
+
+func GetTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	template, err := cc.DB.GetTemplate(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "template not found")
+	} else if err != nil {
+		slog.Error("GetTemplateHandler cc.DB.GetTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, template)
+}
+
+func UpdateTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	saveTemplate := new(SaveTemplate)
+	if err := cc.Bind(saveTemplate); err != nil {
+		slog.Error("UpdateTemplateHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	template, err := cc.DB.GetTemplate(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "template not found")
+	} else if err != nil {
+		slog.Error("UpdateTemplateHandler cc.DB.GetTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	if err := saveTemplate.Apply(template); err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := cc.DB.UpdateTemplate(template); err != nil {
+		slog.Error("UpdateTemplateHandler cc.DB.UpdateTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.JSON(http.StatusOK, template)
+}
+
+func DeleteTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	err := cc.DB.DeleteTemplate(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "template not found")
+	} else if err != nil {
+		slog.Error("DeleteTemplateHandler cc.DB.DeleteTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.NoContent(http.StatusOK)
+}
+
+type RunTemplate struct {
+	// parameter values by name, strings, numbers or booleans
+	Params map[string]any `json:"params"`
+}
+
+// command of `template` with `params` filled in, linked to the template
+func (t *Template) ToCommand(params map[string]any) (*Command, error) {
+	// templates saved before these checks existed
+	if err := CheckPlaceholderQuotes(t.Command); err != nil {
+		return nil, err
+	}
+	if err := CheckTemplateExec(t.Spec.Exec); err != nil {
+		return nil, err
+	}
+	rendered, err := RenderTemplate(t.Command, params)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := t.Spec
+	spec.Command = rendered
+	command, err := spec.ToCommand()
+	if err != nil {
+		return nil, err
+	}
+	command.TemplateId = &t.Id
+	return command, nil
+}
+
+func RunTemplateHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	runTemplate := new(RunTemplate)
+	if err := cc.Bind(runTemplate); err != nil {
+		slog.Error("RunTemplateHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	template, err := cc.DB.GetTemplate(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "template not found")
+	} else if err != nil {
+		slog.Error("RunTemplateHandler cc.DB.GetTemplate", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	command, err := template.ToCommand(runTemplate.Params)
+	if err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	command, err = cc.Dispatcher.Submit(command)
+	if errors.Is(err, ErrUnknownQueue) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if command == nil {
+		slog.Error("RunTemplateHandler cc.Dispatcher.Submit", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	} else if err != nil {
+		slog.Error("RunTemplateHandler cc.Dispatcher.Submit", "error", err)
+		return cc.String(http.StatusInternalServerError, "runner fail")
+	}
+
+	return cc.JSON(http.StatusCreated, command)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	params, err := ParseTemplate("ffmpeg -i {{input:path}} -crf {{crf:int=23}} {{output:path}} && ls {{ input:path }}")
+	if err != nil {
+		t.Fatalf("ParseTemplate error: %s\n", err)
+	}
+	if len(params) != 3 {
+		t.Fatalf("expected 3 params, got %+v\n", params)
+	}
+	if params[0].Name != "input" || params[0].Type != PARAM_PATH || params[0].Default != nil {
+		t.Errorf("unexpected input param %+v\n", params[0])
+	}
+	if params[1].Name != "crf" || params[1].Type != PARAM_INT || *params[1].Default != "23" {
+		t.Errorf("unexpected crf param %+v\n", params[1])
+	}
+
+	params, err = ParseTemplate("docker ps --format '{{.Names}}' {{filter}}")
+	if err != nil || len(params) != 1 || params[0].Type != PARAM_STRING {
+		t.Errorf("unexpected params %+v %v\n", params, err)
+	}
+
+	invalid := []string{
+		"echo {{n:number}}",
+		"echo {{n:int=ten}}",
+		"echo {{n:int}} {{n:float}}",
+		"echo {{n=a}} {{n=b}}",
+	}
+	for _, text := range invalid {
+		if _, err := ParseTemplate(text); err == nil {
+			t.Errorf("expected %q to be invalid\n", text)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	text := "ffmpeg -i {{input:path}} -crf {{crf:int=23}} {{output:path}}"
+
+	rendered, err := RenderTemplate(text, map[string]any{
+		"input":  "my video.mkv",
+		"output": "$(rm -rf ~)'.mp4",
+	})
+	if err != nil {
+		t.Fatalf("RenderTemplate error: %s\n", err)
+	}
+	expected := `ffmpeg -i 'my video.mkv' -crf 23 '$(rm -rf ~)'\''.mp4'`
+	if rendered != expected {
+		t.Errorf("expected %s, got %s\n", expected, rendered)
+	}
+
+	rendered, err = RenderTemplate(text, map[string]any{"input": "a", "output": "b", "crf": float64(18)})
+	if err != nil || rendered != "ffmpeg -i a -crf 18 b" {
+		t.Errorf("unexpected render %s %v\n", rendered, err)
+	}
+
+	invalid := []map[string]any{
+		{"input": "a"},
+		{"input": "a", "output": "b", "crf": "high"},
+		{"input": "a", "output": "b", "preset": "slow"},
+		{"input": "", "output": "b"},
+		{"input": "-rf", "output": "b"},
+	}
+	for _, params := range invalid {
+		if _, err := RenderTemplate(text, params); err == nil {
+			t.Errorf("expected %v to be rejected\n", params)
+		}
+	}
+}
+
+func TestCheckPlaceholderQuotes(t *testing.T) {
+	valid := []string{
+		"ffmpeg -i {{input:path}} -crf {{crf:int=23}} {{output:path}}",
+		"docker ps --format '{{.Names}}' {{filter}}",
+		`echo "it's" {{name}} 'say "hi"' \' {{name}}`,
+		"echo $(date) `id` {{name}} && (cd /tmp; ls {{name}})",
+		`echo "$(echo ")")" {{name}}`,
+		"cat <<'EOF'\nhello {{name}}\nEOF\necho {{name}}",
+		"cat <<\"EOF\" > {{output:path}}\n$(not {{run}})\nEOF",
+		"cat <<-\\EOF\n\thello {{name}}\n\tEOF",
+		"echo $((1 << 2)) {{name}}",
+		"cat <<<{{name}}",
+	}
+	for _, text := range valid {
+		if err := CheckPlaceholderQuotes(text); err != nil {
+			t.Errorf("expected %q to be valid: %s\n", text, err)
+		}
+	}
+
+	invalid := []string{
+		"echo '{{name}}'",
+		`echo "hello {{name}}"`,
+		"echo `cat {{name}}`",
+		"echo $(cat {{name}})",
+		"echo $(cat $(ls) (x) {{name}})",
+		`echo "$(cat {{name}})"`,
+		`echo \"'x' "{{name}}"`,
+		"cat <<EOF\nhello {{name}}\nEOF",
+		"cat <<-EOF | grep x\n\thello {{name}}\n\tEOF",
+		"cat <<'A' <<B\n{{name}}\nA\n{{name}}\nB",
+		"cat <<EOF\nnever closed {{name}}",
+		"cat <<{{name}}\nx\n",
+	}
+	for _, text := range invalid {
+		if err := CheckPlaceholderQuotes(text); err == nil {
+			t.Errorf("expected %q to be rejected\n", text)
+		}
+	}
+
+	save := SaveTemplate{Name: "greet", Command: `echo "hello {{name}}"`}
+	if err := save.Apply(new(Template)); err == nil {
+		t.Errorf("expected quoted placeholder to be rejected\n")
+	}
+}
+
+func TestCheckTemplateExec(t *testing.T) {
+	valid := []*ExecSpec{
+		nil,
+		{Mode: EXEC_SHELL},
+		{Mode: EXEC_SHELL, Shell: "/bin/sh"},
+		{Mode: EXEC_SCRIPT},
+		{Mode: EXEC_SCRIPT, Interpreter: []string{"bash", "-e"}},
+	}
+	for _, spec := range valid {
+		if err := CheckTemplateExec(spec); err != nil {
+			t.Errorf("expected %+v to be valid: %s\n", spec, err)
+		}
+	}
+
+	invalid := []*ExecSpec{
+		{Mode: EXEC_ARGV, Argv: []string{"echo"}},
+		{Mode: EXEC_SHELL, Shell: "fish"},
+		{Mode: EXEC_SCRIPT, Interpreter: []string{"python3"}},
+	}
+	for _, spec := range invalid {
+		if err := CheckTemplateExec(spec); err == nil {
+			t.Errorf("expected %+v to be rejected\n", spec)
+		}
+	}
+
+	save := SaveTemplate{
+		Name:    "py",
+		Command: "print({{name}})",
+		Spec:    NewCommand{Exec: &ExecSpec{Mode: EXEC_SCRIPT, Interpreter: []string{"python3"}}},
+	}
+	if err := save.Apply(new(Template)); err == nil {
+		t.Errorf("expected python script to be rejected\n")
+	}
+}
+
+func TestTemplateCommand(t *testing.T) {
+	bus := NewEventBus()
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+
+	save := SaveTemplate{Name: "greet", Command: "echo {{name=world}}", Spec: NewCommand{Timeout: "1m"}}
+	template := new(Template)
+	if err := save.Apply(template); err != nil {
+		t.Fatalf("Apply error: %s\n", err)
+	}
+	template, err = db.NewTemplate(template)
+	if err != nil {
+		t.Fatalf("NewTemplate error: %s\n", err)
+	}
+
+	stored, err := db.GetTemplate(template.Id)
+	if err != nil {
+		t.Fatalf("GetTemplate error: %s\n", err)
+	}
+	if len(stored.Params) != 1 || stored.Spec.Timeout != "1m" {
+		t.Errorf("unexpected stored template %+v\n", stored)
+	}
+
+	command, err := stored.ToCommand(map[string]any{"name": "a b"})
+	if err != nil {
+		t.Fatalf("ToCommand error: %s\n", err)
+	}
+	if command.Command != "echo 'a b'" || command.TimeoutMs == nil || *command.TemplateId != template.Id {
+		t.Errorf("unexpected command %+v\n", command)
+	}
+
+	if err := db.DeleteTemplate(template.Id); err != nil {
+		t.Errorf("DeleteTemplate error: %s\n", err)
+	}
+}
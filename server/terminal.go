@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// raw output kept per session and replayed to a terminal when it attaches
+const TERMINAL_SCROLLBACK = 64 * 1024
+
+// output chunks buffered per attached terminal, a terminal falling further
+// behind is detached instead of blocking the command's output
+const TERMINAL_BUFFER = 256
+
+// Raw stdout and stderr of a session fanned out to attached terminals,
+// unlike the log topic the bytes are not split into lines
+type TerminalOutput struct {
+	mu         sync.Mutex
+	scrollback []byte
+	subs       map[chan []byte]struct{}
+	// subscribers detached for falling behind, until they detach themselves
+	behind map[chan []byte]struct{}
+	closed bool
+}
+
+func NewTerminalOutput() *TerminalOutput {
+	return &TerminalOutput{
+		subs:   make(map[chan []byte]struct{}),
+		behind: make(map[chan []byte]struct{}),
+	}
+}
+
+func (o *TerminalOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	o.scrollback = append(o.scrollback, data...)
+	if over := len(o.scrollback) - TERMINAL_SCROLLBACK; over > 0 {
+		o.scrollback = append(o.scrollback[:0], o.scrollback[over:]...)
+	}
+
+	for c := range o.subs {
+		select {
+		case c <- data:
+		default:
+			delete(o.subs, c)
+			o.behind[c] = struct{}{}
+			close(c)
+		}
+	}
+	return len(p), nil
+}
+
+// recent output and a channel receiving everything written after it,
+// the channel is closed when the output ends or the subscriber falls behind
+func (o *TerminalOutput) Attach() ([]byte, chan []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	scrollback := make([]byte, len(o.scrollback))
+	copy(scrollback, o.scrollback)
+
+	c := make(chan []byte, TERMINAL_BUFFER)
+	if o.closed {
+		close(c)
+	} else {
+		o.subs[c] = struct{}{}
+	}
+	return scrollback, c
+}
+
+func (o *TerminalOutput) detach(c chan []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.behind, c)
+	if _, found := o.subs[c]; found {
+		delete(o.subs, c)
+		close(c)
+	}
+}
+
+func (o *TerminalOutput) fellBehind(c chan []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, found := o.behind[c]
+	return found
+}
+
+// called once the process exited and its output is drained
+func (o *TerminalOutput) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	for c := range o.subs {
+		close(c)
+	}
+	clear(o.subs)
+}
+
+// A client attached to a running session, like `tmux attach`
+type Terminal struct {
+	session *Session
+	// output written before the terminal attached
+	Scrollback []byte
+	Output     <-chan []byte
+	output     chan []byte
+}
+
+func (s *Session) Attach() (*Terminal, error) {
+	if s.output == nil {
+		return nil, fmt.Errorf("output of command %s is not captured", s.Id)
+	}
+	select {
+	case <-s.done:
+		return nil, fmt.Errorf("command %s has finished", s.Id)
+	default:
+	}
+
+	scrollback, output := s.output.Attach()
+	return &Terminal{
+		session:    s,
+		Scrollback: scrollback,
+		Output:     output,
+		output:     output,
+	}, nil
+}
+
+// write keystrokes to stdin. a tty echoes them back on its own so they are
+// only recorded as LOG_STDIN for commands reading from a pipe
+func (t *Terminal) Write(data []byte) error {
+	s := t.session
+	if s.pty == nil {
+		return s.Input(data, false)
+	}
+
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+	if err := s.checkInput(); err != nil {
+		return err
+	}
+	_, err := s.stdin.Write(data)
+	return err
+}
+
+// closed once the command finished and its status is written
+func (t *Terminal) Done() <-chan struct{} {
+	return t.session.done
+}
+
+// `Output` was closed because the terminal could not keep up with it
+func (t *Terminal) FellBehind() bool {
+	return t.session.output.fellBehind(t.output)
+}
+
+// stop receiving output, closes `Output`
+func (t *Terminal) Detach() {
+	t.session.output.detach(t.output)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+type TerminalMessageType string
+
+const (
+	// client: resize the tty to `rows` x `cols`
+	TERMINAL_RESIZE TerminalMessageType = "resize"
+	// client: close stdin, ^D on a tty
+	TERMINAL_CLOSE TerminalMessageType = "close"
+	// server: the command finished, carries the final command
+	TERMINAL_EXIT TerminalMessageType = "exit"
+	// server: a client message could not be applied
+	TERMINAL_ERROR TerminalMessageType = "error"
+)
+
+// Control message sent as a text frame. Binary frames carry raw bytes,
+// stdin from the client and stdout/stderr from the server.
+type TerminalMessage struct {
+	Type    TerminalMessageType `json:"type"`
+	Rows    int                 `json:"rows,omitempty"`
+	Cols    int                 `json:"cols,omitempty"`
+	Command *Command            `json:"command,omitempty"`
+	Error   string              `json:"error,omitempty"`
+	// raw stdin of a binary frame, not part of the json
+	data []byte
+}
+
+var terminalCodec = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		data, err := json.Marshal(v)
+		return data, websocket.TextFrame, err
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		msg := v.(*TerminalMessage)
+		if payloadType == websocket.BinaryFrame {
+			msg.data = data
+			return nil
+		}
+		return json.Unmarshal(data, msg)
+	},
+}
+
+// attach to a running command over websocket like `tmux attach`,
+// the recent output is replayed first
+func TerminalHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	terminal, err := cc.Runner.Attach(cc.Param("id"))
+	if err != nil {
+		slog.Error("TerminalHandler cc.Runner.Attach", "error", err)
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+	defer terminal.Detach()
+
+	// no origin check, like the CORS config of the rest of the api
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		ServeTerminal(cc, ws, terminal)
+	}}
+	server.ServeHTTP(cc.Response(), cc.Request())
+	return nil
+}
+
+func ServeTerminal(cc *CockpitContext, ws *websocket.Conn, terminal *Terminal) {
+	defer ws.Close()
+	commandId := cc.Param("id")
+
+	go func() {
+		// a disconnected client detaches, which ends the output loop below
+		defer terminal.Detach()
+		for {
+			var msg TerminalMessage
+			if err := terminalCodec.Receive(ws, &msg); err != nil {
+				return
+			}
+			if err := applyTerminalMessage(cc, terminal, &msg); err != nil {
+				terminalCodec.Send(ws, &TerminalMessage{Type: TERMINAL_ERROR, Error: err.Error()})
+			}
+		}
+	}()
+
+	if len(terminal.Scrollback) > 0 {
+		if err := websocket.Message.Send(ws, terminal.Scrollback); err != nil {
+			return
+		}
+	}
+	for data := range terminal.Output {
+		if err := websocket.Message.Send(ws, data); err != nil {
+			return
+		}
+	}
+
+	if terminal.FellBehind() {
+		terminalCodec.Send(ws, &TerminalMessage{
+			Type:  TERMINAL_ERROR,
+			Error: "terminal fell behind the output, attach again",
+		})
+		return
+	}
+	select {
+	case <-terminal.Done():
+	default:
+		// detached by the client
+		return
+	}
+
+	command, err := cc.DB.GetCommand(commandId)
+	if err != nil {
+		slog.Error("ServeTerminal cc.DB.GetCommand", "error", err)
+		return
+	}
+	terminalCodec.Send(ws, &TerminalMessage{Type: TERMINAL_EXIT, Command: command})
+}
+
+func applyTerminalMessage(cc *CockpitContext, terminal *Terminal, msg *TerminalMessage) error {
+	commandId := cc.Param("id")
+	if msg.data != nil {
+		return terminal.Write(msg.data)
+	}
+
+	switch msg.Type {
+	case TERMINAL_RESIZE:
+		if err := ValidateTtySize(msg.Rows, msg.Cols); err != nil {
+			return err
+		}
+		return cc.Runner.Resize(commandId, uint16(msg.Rows), uint16(msg.Cols))
+	case TERMINAL_CLOSE:
+		return cc.Runner.CloseInput(commandId)
+	}
+	return fmt.Errorf("unknown terminal message type %q", msg.Type)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+func TestTerminalHandler(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+filepath.Join(t.TempDir(), "terminal.db"), bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	defer db.(*CockpitDB).Close()
+
+	e := echo.New()
+	e.Use(CockpitContextMiddleware(runner, db, bus, nil, nil, nil))
+	e.GET("/api/v1/command/:id/terminal", TerminalHandler)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	command, err := db.NewCommand(&Command{
+		Command: "read name; echo \"hello $name\"",
+		Stdin:   true,
+	})
+	if err != nil {
+		t.Fatalf("db NewCommand error: %s\n", err)
+	}
+	if err := runner.Run(db, command); err != nil {
+		t.Fatalf("runner.Run error: %s\n", err)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/command/" + command.Id + "/terminal"
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %s\n", err)
+	}
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := websocket.Message.Send(ws, []byte("world\n")); err != nil {
+		t.Fatalf("send stdin error: %s\n", err)
+	}
+
+	output := ""
+	for {
+		var msg TerminalMessage
+		if err := terminalCodec.Receive(ws, &msg); err != nil {
+			t.Fatalf("receive error: %s, output %q\n", err, output)
+		}
+		if msg.data != nil {
+			output += string(msg.data)
+			continue
+		}
+		if msg.Type != TERMINAL_EXIT {
+			t.Fatalf("unexpected message %+v\n", msg)
+		}
+		if msg.Command == nil || msg.Command.Id != command.Id || msg.Command.Status != COMMAND_EXITED {
+			t.Errorf("unexpected exit command %+v\n", msg.Command)
+		}
+		break
+	}
+	if output != "hello world\n" {
+		t.Errorf("unexpected terminal output %q\n", output)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -15,3 +17,7 @@ func IdGen() string {
 func FormatNow() string {
 	return time.Now().UTC().Format(time.RFC3339Nano)
 }
+
+func IsNoRows(err error) bool {
+	return errors.Is(err, sql.ErrNoRows)
+}
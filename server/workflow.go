@@ -0,0 +1,519 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+type WorkflowStatus string
+
+const (
+	WORKFLOW_RUNNING WorkflowStatus = "RUNNING"
+	// every node exited successfully or was skipped
+	WORKFLOW_SUCCEEDED WorkflowStatus = "SUCCEEDED"
+	// a node failed, even if a failure branch handled it
+	WORKFLOW_FAILED WorkflowStatus = "FAILED"
+	// a node was canceled and none failed
+	WORKFLOW_CANCELED WorkflowStatus = "CANCELED"
+)
+
+func (s WorkflowStatus) IsFinished() bool {
+	return s != WORKFLOW_RUNNING
+}
+
+type DependencyCondition string
+
+const (
+	// the dependency exited with code 0
+	DEPENDS_SUCCESS DependencyCondition = "success"
+	// the dependency ran and failed, timed out or was lost
+	DEPENDS_FAILURE DependencyCondition = "failure"
+	// the dependency finished in any way
+	DEPENDS_ALWAYS DependencyCondition = "always"
+)
+
+// Edge from a workflow node to a node it waits for
+type Dependency struct {
+	Node      string              `json:"node"`
+	Condition DependencyCondition `json:"condition"`
+}
+
+// whether the finished `command` lets the dependent node run
+func (d *Dependency) Satisfied(command *Command) bool {
+	switch d.Condition {
+	case DEPENDS_SUCCESS:
+		return command.Status == COMMAND_EXITED
+	case DEPENDS_FAILURE:
+		return command.Status.IsFailed()
+	case DEPENDS_ALWAYS:
+		return true
+	}
+	return false
+}
+
+// dependencies of a workflow node, stored as a json array in the command table
+type Dependencies []Dependency
+
+func (d Dependencies) Value() (driver.Value, error) {
+	if d == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (d *Dependencies) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	case []byte:
+		return json.Unmarshal(v, d)
+	default:
+		return fmt.Errorf("cannot scan %T into Dependencies", src)
+	}
+}
+
+// Resolve the dependencies against the latest attempt of every node.
+// `ready` is false while a dependency has not finished or will be retried,
+// `unmet` is the first dependency whose condition does not hold
+func (d Dependencies) Resolve(nodes map[string]*Command) (ready bool, unmet *Dependency) {
+	for i := range d {
+		node, found := nodes[d[i].Node]
+		if !found || !node.Status.IsFinished() || node.WillRetry() {
+			return false, nil
+		}
+	}
+	for i := range d {
+		if !d[i].Satisfied(nodes[d[i].Node]) {
+			return true, &d[i]
+		}
+	}
+	return true, nil
+}
+
+// Commands started in order of the dependencies between them
+type Workflow struct {
+	Id         string         `json:"id"`
+	CreatedAt  string         `json:"createdAt"`
+	Name       string         `json:"name"`
+	Status     WorkflowStatus `json:"status"`
+	FinishedAt *string        `json:"finishedAt"`
+	// latest attempt of each node, in dependency order
+	Nodes []Command `json:"nodes"`
+}
+
+// status of the workflow following from its nodes
+func (w *Workflow) NodeStatus() WorkflowStatus {
+	status := WORKFLOW_SUCCEEDED
+	for i := range w.Nodes {
+		node := &w.Nodes[i]
+		switch {
+		case !node.Status.IsFinished() || node.WillRetry():
+			return WORKFLOW_RUNNING
+		case node.Status.IsFailed():
+			status = WORKFLOW_FAILED
+		case node.Status == COMMAND_CANCELED && status == WORKFLOW_SUCCEEDED:
+			status = WORKFLOW_CANCELED
+		}
+	}
+	return status
+}
+
+type WorkflowEvent struct {
+	*Workflow
+	Type CommandEventType `json:"type"`
+}
+
+func WorkflowMessage(workflow *Workflow, ty CommandEventType) *WorkflowEvent {
+	return &WorkflowEvent{
+		Workflow: workflow,
+		Type:     ty,
+	}
+}
+
+const WORKFLOW_COLUMNS = `
+id, created_at, name, status, finished_at
+`
+const INSERT_WORKFLOW_QUERY = `
+INSERT INTO workflow (` + WORKFLOW_COLUMNS + `)
+VALUES (?, ?, ?, ?, ?);
+`
+const SELECT_WORKFLOW_QUERY = `
+SELECT ` + WORKFLOW_COLUMNS + `
+FROM workflow
+WHERE id = $1;
+`
+const LIST_WORKFLOW_QUERY = `
+SELECT ` + WORKFLOW_COLUMNS + `
+FROM workflow
+WHERE id < $1
+ORDER BY id DESC
+LIMIT $2;
+`
+const LIST_WORKFLOW_BY_STATUS_QUERY = `
+SELECT ` + WORKFLOW_COLUMNS + `
+FROM workflow
+WHERE status IN (SELECT value FROM json_each($1))
+ORDER BY id;
+`
+
+// latest attempt of each node ordered by the node's first attempt,
+// which were inserted in dependency order
+const SELECT_WORKFLOW_NODES_QUERY = `
+SELECT ` + COMMAND_COLUMNS + `
+FROM command c
+WHERE c.id IN (
+    SELECT MAX(id) FROM command WHERE workflow_id = $1 GROUP BY workflow_node
+)
+ORDER BY (
+    SELECT MIN(id) FROM command WHERE workflow_id = $1 AND workflow_node = c.workflow_node
+);
+`
+const UPDATE_WORKFLOW_STATUS_QUERY = `
+UPDATE workflow
+SET status = ?, finished_at = ?
+WHERE id = ?;
+`
+const RELEASE_PENDING_QUERY = `
+UPDATE command
+SET status = CASE WHEN queue = '' THEN 'IDLE' ELSE 'QUEUED' END
+WHERE id = ? AND status = 'PENDING'
+RETURNING status;
+`
+const SKIP_PENDING_QUERY = `
+UPDATE command
+SET status = 'SKIPPED', finished_at = ?
+WHERE id = ? AND status = 'PENDING';
+`
+
+func (db *CockpitDB) NewWorkflow(workflow *Workflow) (*Workflow, error) {
+	workflowInfo := *workflow
+	workflowInfo.Id = IdGen()
+	workflowInfo.CreatedAt = FormatNow()
+	workflowInfo.Status = WORKFLOW_RUNNING
+
+	_, err := db.Exec(
+		INSERT_WORKFLOW_QUERY,
+		workflowInfo.Id,
+		workflowInfo.CreatedAt,
+		workflowInfo.Name,
+		workflowInfo.Status,
+		workflowInfo.FinishedAt,
+	)
+	if err != nil {
+		slog.Error("failed to insert new workflow", "error", err)
+		return nil, err
+	}
+
+	return &workflowInfo, nil
+}
+
+func (db *CockpitDB) GetWorkflow(id string) (*Workflow, error) {
+	var w Workflow
+
+	row := db.QueryRow(SELECT_WORKFLOW_QUERY, id)
+	if err := row.Scan(&w.Id, &w.CreatedAt, &w.Name, &w.Status, &w.FinishedAt); err != nil {
+		return nil, err
+	}
+	if err := db.getWorkflowNodes(&w); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (db *CockpitDB) ListWorkflows(before string, n uint) ([]Workflow, error) {
+	if len(before) == 0 {
+		before = MAX_ID
+	}
+	return db.listWorkflows(LIST_WORKFLOW_QUERY, before, n)
+}
+
+// list workflows in any of `statuses`, oldest first
+func (db *CockpitDB) ListWorkflowsByStatus(statuses ...WorkflowStatus) ([]Workflow, error) {
+	statusList, err := json.Marshal(statuses)
+	if err != nil {
+		return nil, err
+	}
+	return db.listWorkflows(LIST_WORKFLOW_BY_STATUS_QUERY, string(statusList))
+}
+
+func (db *CockpitDB) listWorkflows(query string, args ...any) ([]Workflow, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	workflows := []Workflow{}
+	for rows.Next() {
+		var w Workflow
+		err := rows.Scan(&w.Id, &w.CreatedAt, &w.Name, &w.Status, &w.FinishedAt)
+		if err != nil {
+			slog.Error("listWorkflows", "error", err)
+			continue
+		}
+
+		workflows = append(workflows, w)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return workflows, err
+	}
+
+	for i := range workflows {
+		if err := db.getWorkflowNodes(&workflows[i]); err != nil {
+			return workflows, err
+		}
+	}
+	return workflows, nil
+}
+
+func (db *CockpitDB) getWorkflowNodes(workflow *Workflow) error {
+	rows, err := db.Query(SELECT_WORKFLOW_NODES_QUERY, workflow.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	workflow.Nodes = []Command{}
+	for rows.Next() {
+		var c Command
+		err := scanCommand(rows, &c)
+		if err != nil {
+			slog.Error("getWorkflowNodes", "error", err)
+			continue
+		}
+
+		workflow.Nodes = append(workflow.Nodes, c)
+	}
+	return rows.Err()
+}
+
+func (db *CockpitDB) UpdateWorkflowStatus(workflow *Workflow) error {
+	_, err := db.Exec(UPDATE_WORKFLOW_STATUS_QUERY, workflow.Status, workflow.FinishedAt, workflow.Id)
+	if err != nil {
+		slog.Error("failed to update workflow status", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (db *CockpitDB) ReleasePending(id string) (CommandStatus, error) {
+	var status CommandStatus
+	if err := db.QueryRow(RELEASE_PENDING_QUERY, id).Scan(&status); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+func (db *CockpitDB) SkipPending(id string) error {
+	result, err := db.Exec(SKIP_PENDING_QUERY, FormatNow(), id)
+	if err != nil {
+		slog.Error("failed to skip pending command", "error", err)
+		return err
+	}
+	return expectAffected(result, sql.ErrNoRows)
+}
+
+// Insert the workflow with every node PENDING and start the nodes without
+// dependencies. `nodes` must be in dependency order.
+func (d *Dispatcher) SubmitWorkflow(workflow *Workflow, nodes []*Command) (*Workflow, error) {
+	for _, node := range nodes {
+		if err := d.checkQueue(node.Queue); err != nil {
+			return nil, err
+		}
+	}
+
+	workflow, err := d.DB.NewWorkflow(workflow)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		node.WorkflowId = &workflow.Id
+		node.Status = COMMAND_PENDING
+
+		command, err := d.DB.NewCommand(node)
+		if err != nil {
+			// nodes inserted so far are canceled by failing the workflow
+			d.failWorkflow(workflow.Id, fmt.Sprintf("failed to insert node %s: %s", node.WorkflowNode, err))
+			return nil, err
+		}
+
+		msg := CommandMessage(command, COMMAND_CREATE)
+		if err := Pub[any](d.Bus, "command", msg); err != nil {
+			slog.Error("failed to send create command message", "message", msg, "error", err)
+		}
+	}
+
+	workflow, err = d.DB.GetWorkflow(workflow.Id)
+	if err != nil {
+		return nil, err
+	}
+	msg := WorkflowMessage(workflow, COMMAND_CREATE)
+	if err := Pub(d.Bus, "workflow", msg); err != nil {
+		slog.Error("failed to send create workflow message", "message", msg, "error", err)
+	}
+
+	return d.AdvanceWorkflow(workflow.Id)
+}
+
+func (d *Dispatcher) failWorkflow(id string, reason string) {
+	workflow, err := d.DB.GetWorkflow(id)
+	if err != nil {
+		slog.Error("Dispatcher.failWorkflow db.GetWorkflow", "id", id, "error", err)
+		return
+	}
+	for _, node := range workflow.Nodes {
+		if err := d.DB.CancelQueued(node.Id); err != nil {
+			continue
+		}
+		AddErrorLog(d.DB, node.Id, reason)
+
+		msg := CommandMessage(&Command{Id: node.Id, Status: COMMAND_CANCELED}, COMMAND_UPDATE)
+		if err := Pub[any](d.Bus, "command", msg); err != nil {
+			slog.Error("failed to send update command message", "message", msg, "error", err)
+		}
+	}
+
+	finishedAt := FormatNow()
+	workflow.Status = WORKFLOW_FAILED
+	workflow.FinishedAt = &finishedAt
+	d.DB.UpdateWorkflowStatus(workflow)
+}
+
+// advance the workflow of a finished command, if it belongs to one
+func (d *Dispatcher) AdvanceNode(id string) {
+	command, err := d.DB.GetCommand(id)
+	if err != nil {
+		slog.Error("Dispatcher.AdvanceNode db.GetCommand", "id", id, "error", err)
+		return
+	}
+	if command.WorkflowId == nil {
+		return
+	}
+	if _, err := d.AdvanceWorkflow(*command.WorkflowId); err != nil {
+		slog.Error("Dispatcher.AdvanceNode", "workflow", *command.WorkflowId, "error", err)
+	}
+}
+
+// advance every running workflow, for nodes that finished while the
+// dispatcher was not listening
+func (d *Dispatcher) AdvanceWorkflows() {
+	workflows, err := d.DB.ListWorkflowsByStatus(WORKFLOW_RUNNING)
+	if err != nil {
+		slog.Error("Dispatcher.AdvanceWorkflows db.ListWorkflowsByStatus", "error", err)
+		return
+	}
+	for _, workflow := range workflows {
+		if _, err := d.AdvanceWorkflow(workflow.Id); err != nil {
+			slog.Error("Dispatcher.AdvanceWorkflows", "workflow", workflow.Id, "error", err)
+		}
+	}
+}
+
+// Start the pending nodes whose dependencies are met and skip the ones
+// whose dependencies finished without meeting their conditions, which in
+// turn skips the nodes depending on them. Then update the workflow status.
+func (d *Dispatcher) AdvanceWorkflow(id string) (*Workflow, error) {
+	d.workflowMu.Lock()
+	defer d.workflowMu.Unlock()
+
+	workflow, err := d.DB.GetWorkflow(id)
+	if err != nil {
+		return nil, err
+	}
+	if workflow.Status.IsFinished() {
+		return workflow, nil
+	}
+
+	nodes := map[string]*Command{}
+	for i := range workflow.Nodes {
+		nodes[workflow.Nodes[i].WorkflowNode] = &workflow.Nodes[i]
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := range workflow.Nodes {
+			node := &workflow.Nodes[i]
+			// retry attempts are released by their timer
+			if node.Status != COMMAND_PENDING || node.RetryAt != nil {
+				continue
+			}
+
+			ready, unmet := node.DependsOn.Resolve(nodes)
+			if !ready {
+				continue
+			}
+			changed = true
+			if unmet != nil {
+				d.skip(node, unmet)
+			} else {
+				d.release(node, "workflow node")
+			}
+		}
+	}
+
+	status := workflow.NodeStatus()
+	if status.IsFinished() {
+		finishedAt := FormatNow()
+		workflow.FinishedAt = &finishedAt
+	}
+	workflow.Status = status
+	if err := d.DB.UpdateWorkflowStatus(workflow); err != nil {
+		return nil, err
+	}
+
+	msg := WorkflowMessage(workflow, COMMAND_UPDATE)
+	if err := Pub(d.Bus, "workflow", msg); err != nil {
+		slog.Error("failed to send update workflow message", "message", msg, "error", err)
+	}
+	return workflow, nil
+}
+
+func (d *Dispatcher) skip(node *Command, unmet *Dependency) {
+	// fails if the node was canceled in the meantime
+	if err := d.DB.SkipPending(node.Id); err != nil {
+		node.Status = COMMAND_CANCELED
+		return
+	}
+	node.Status = COMMAND_SKIPPED
+	AddErrorLog(d.DB, node.Id, fmt.Sprintf(
+		"skipped, %s did not meet condition %s", unmet.Node, unmet.Condition,
+	))
+
+	msg := CommandMessage(&Command{Id: node.Id, Status: COMMAND_SKIPPED}, COMMAND_UPDATE)
+	if err := Pub[any](d.Bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+}
+
+// move a PENDING workflow node or retry attempt to IDLE or QUEUED and run it
+func (d *Dispatcher) release(node *Command, kind string) {
+	status, err := d.DB.ReleasePending(node.Id)
+	// fails if the node was canceled in the meantime
+	if err != nil {
+		node.Status = COMMAND_CANCELED
+		return
+	}
+	node.Status = status
+
+	msg := CommandMessage(&Command{Id: node.Id, Status: status}, COMMAND_UPDATE)
+	if err := Pub[any](d.Bus, "command", msg); err != nil {
+		slog.Error("failed to send update command message", "message", msg, "error", err)
+	}
+
+	if status == COMMAND_QUEUED {
+		d.Kick()
+		return
+	}
+	d.run(node, kind)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type NewWorkflow struct {
+	Name  string            `json:"name"`
+	Nodes []NewWorkflowNode `json:"nodes"`
+}
+
+type NewWorkflowNode struct {
+	// unique within the workflow, dependencies refer to nodes by name
+	Name      string          `json:"name"`
+	Spec      NewCommand      `json:"spec"`
+	DependsOn []NewDependency `json:"dependsOn"`
+}
+
+type NewDependency struct {
+	Node string `json:"node"`
+	// `success`, `failure` or `always`, defaults to success
+	Condition string `json:"condition"`
+}
+
+// validate the request and convert its nodes to commands in dependency order
+func (n *NewWorkflow) ToNodes() ([]*Command, error) {
+	if len(n.Nodes) == 0 {
+		return nil, fmt.Errorf("workflow has no nodes")
+	}
+
+	specs := map[string]*NewWorkflowNode{}
+	for i := range n.Nodes {
+		node := &n.Nodes[i]
+		if len(node.Name) == 0 {
+			return nil, fmt.Errorf("node %d has no name", i)
+		}
+		if _, found := specs[node.Name]; found {
+			return nil, fmt.Errorf("duplicate node %s", node.Name)
+		}
+		specs[node.Name] = node
+	}
+
+	commands := map[string]*Command{}
+	for _, node := range n.Nodes {
+		command, err := node.Spec.ToCommand()
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", node.Name, err)
+		}
+		command.WorkflowNode = node.Name
+
+		for _, dep := range node.DependsOn {
+			condition := DependencyCondition(dep.Condition)
+			switch condition {
+			case "":
+				condition = DEPENDS_SUCCESS
+			case DEPENDS_SUCCESS, DEPENDS_FAILURE, DEPENDS_ALWAYS:
+			default:
+				return nil, fmt.Errorf("node %s: invalid condition %s", node.Name, dep.Condition)
+			}
+			if _, found := specs[dep.Node]; !found {
+				return nil, fmt.Errorf("node %s depends on unknown node %s", node.Name, dep.Node)
+			}
+			if slices.ContainsFunc(command.DependsOn, func(d Dependency) bool { return d.Node == dep.Node }) {
+				return nil, fmt.Errorf("node %s depends on %s twice", node.Name, dep.Node)
+			}
+			command.DependsOn = append(command.DependsOn, Dependency{Node: dep.Node, Condition: condition})
+		}
+		commands[node.Name] = command
+	}
+
+	// nodes come out in request order as soon as their dependencies did
+	ordered := make([]*Command, 0, len(n.Nodes))
+	done := map[string]bool{}
+	for len(ordered) < len(n.Nodes) {
+		progressed := false
+		for _, node := range n.Nodes {
+			command := commands[node.Name]
+			if done[node.Name] || slices.ContainsFunc(command.DependsOn, func(d Dependency) bool { return !done[d.Node] }) {
+				continue
+			}
+			done[node.Name] = true
+			ordered = append(ordered, command)
+			progressed = true
+		}
+		if !progressed {
+			return nil, fmt.Errorf("workflow has a dependency cycle")
+		}
+	}
+	return ordered, nil
+}
+
+func NewWorkflowHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+	newWorkflow := new(NewWorkflow)
+	if err := cc.Bind(newWorkflow); err != nil {
+		slog.Error("NewWorkflowHandler cc.Bind", "error", err)
+		return cc.String(http.StatusBadRequest, "invalid json format")
+	}
+
+	nodes, err := newWorkflow.ToNodes()
+	if err != nil {
+		return cc.String(http.StatusBadRequest, err.Error())
+	}
+
+	workflow, err := cc.Dispatcher.SubmitWorkflow(&Workflow{Name: newWorkflow.Name}, nodes)
+	if errors.Is(err, ErrUnknownQueue) {
+		return cc.String(http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		slog.Error("NewWorkflowHandler cc.Dispatcher.SubmitWorkflow", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.JSON(http.StatusCreated, workflow)
+}
+
+func GetWorkflowHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	workflow, err := cc.DB.GetWorkflow(cc.Param("id"))
+	if IsNoRows(err) {
+		return cc.String(http.StatusNotFound, "workflow not found")
+	} else if err != nil {
+		slog.Error("GetWorkflowHandler cc.DB.GetWorkflow", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+	return cc.JSON(http.StatusOK, workflow)
+}
+
+func ListWorkflowHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	before := cc.QueryParam("before")
+	limit, err := strconv.Atoi(cc.QueryParam("limit"))
+	if err != nil {
+		return cc.String(http.StatusBadRequest, "invalid limit param")
+	}
+	if limit < 0 {
+		return cc.String(http.StatusBadRequest, "negative limit param")
+	}
+
+	workflows, err := cc.DB.ListWorkflows(before, uint(limit))
+	if err != nil {
+		slog.Error("ListWorkflowHandler cc.DB.ListWorkflows", "error", err)
+		return cc.String(http.StatusInternalServerError, "db fail")
+	}
+
+	return cc.JSON(http.StatusOK, workflows)
+}
+
+// workflows as they are created and every time one of their nodes finishes
+func WorkflowStreamHandler(c echo.Context) error {
+	cc := c.(*CockpitContext)
+
+	rc, unsub, err := SubChan[*WorkflowEvent](cc.Bus, "workflow")
+	if err != nil {
+		slog.Error("WorkflowStreamHandler SubChan", "error", err)
+		return cc.String(http.StatusInternalServerError, "runner fail")
+	}
+
+	w := cc.Response()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		select {
+		case <-cc.Request().Context().Done():
+			unsub()
+			return nil
+		case msg := <-rc:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				slog.Error("WorkflowStreamHandler json.Marshal(msg)", "error", err)
+				continue
+			}
+			event := Event{Data: data}
+
+			if err := event.MarshalTo(w); err != nil {
+				return err
+			}
+			w.Flush()
+		}
+	}
+}
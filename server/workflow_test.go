@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkflowNodes(t *testing.T) {
+	workflow := NewWorkflow{Nodes: []NewWorkflowNode{
+		{Name: "move", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "transcode"}}},
+		{Name: "transcode", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "download"}}},
+		{Name: "download", Spec: NewCommand{Command: "true"}},
+	}}
+	nodes, err := workflow.ToNodes()
+	if err != nil {
+		t.Fatalf("ToNodes error: %s\n", err)
+	}
+	order := []string{}
+	for _, node := range nodes {
+		order = append(order, node.WorkflowNode)
+	}
+	if len(order) != 3 || order[0] != "download" || order[1] != "transcode" || order[2] != "move" {
+		t.Errorf("unexpected order %v\n", order)
+	}
+	if nodes[1].DependsOn[0].Condition != DEPENDS_SUCCESS {
+		t.Errorf("expected success to be the default condition\n")
+	}
+
+	invalid := []NewWorkflow{
+		{},
+		{Nodes: []NewWorkflowNode{{Name: "a"}, {Name: "a"}}},
+		{Nodes: []NewWorkflowNode{{Name: "a", DependsOn: []NewDependency{{Node: "b"}}}}},
+		{Nodes: []NewWorkflowNode{{Name: "a", DependsOn: []NewDependency{{Node: "a"}}}}},
+		{Nodes: []NewWorkflowNode{
+			{Name: "a", DependsOn: []NewDependency{{Node: "b"}}},
+			{Name: "b", DependsOn: []NewDependency{{Node: "a", Condition: "always"}}},
+		}},
+		{Nodes: []NewWorkflowNode{{Name: "a"}, {Name: "b", DependsOn: []NewDependency{{Node: "a", Condition: "later"}}}}},
+	}
+	for i, workflow := range invalid {
+		if _, err := workflow.ToNodes(); err == nil {
+			t.Errorf("expected workflow %d to be invalid\n", i)
+		}
+	}
+}
+
+func TestWorkflow(t *testing.T) {
+	bus := NewEventBus()
+	CreateTopic[any](bus, "command")
+	CreateTopic[*WorkflowEvent](bus, "workflow")
+
+	runner := NewRunner(bus)
+	db, err := NewDB("file:"+t.TempDir()+"/test.db", bus)
+	if err != nil {
+		t.Fatalf("NewDB error: %s\n", err)
+	}
+	dispatcher := NewDispatcher(db, runner, bus)
+	go dispatcher.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	request := NewWorkflow{Name: "chain", Nodes: []NewWorkflowNode{
+		{Name: "download", Spec: NewCommand{Command: "true"}},
+		{Name: "transcode", Spec: NewCommand{Command: "exit 2"}, DependsOn: []NewDependency{{Node: "download"}}},
+		{Name: "cleanup", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "download", Condition: "failure"}}},
+		{Name: "move", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "transcode"}}},
+		{Name: "archive", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "move"}}},
+		{Name: "notify", Spec: NewCommand{Command: "true"}, DependsOn: []NewDependency{{Node: "transcode", Condition: "always"}}},
+	}}
+	nodes, err := request.ToNodes()
+	if err != nil {
+		t.Fatalf("ToNodes error: %s\n", err)
+	}
+	workflow, err := dispatcher.SubmitWorkflow(&Workflow{Name: request.Name}, nodes)
+	if err != nil {
+		t.Fatalf("SubmitWorkflow error: %s\n", err)
+	}
+
+	for range 50 {
+		time.Sleep(100 * time.Millisecond)
+		workflow, err = db.GetWorkflow(workflow.Id)
+		if err != nil {
+			t.Fatalf("GetWorkflow error: %s\n", err)
+		}
+		if workflow.Status.IsFinished() {
+			break
+		}
+	}
+
+	if workflow.Status != WORKFLOW_FAILED || workflow.FinishedAt == nil {
+		t.Errorf("unexpected workflow status %s\n", workflow.Status)
+	}
+	expected := map[string]CommandStatus{
+		"download":  COMMAND_EXITED,
+		"transcode": COMMAND_ERROR,
+		"cleanup":   COMMAND_SKIPPED,
+		"move":      COMMAND_SKIPPED,
+		"archive":   COMMAND_SKIPPED,
+		"notify":    COMMAND_EXITED,
+	}
+	if len(workflow.Nodes) != len(expected) {
+		t.Fatalf("expected %d nodes, got %d\n", len(expected), len(workflow.Nodes))
+	}
+	for _, node := range workflow.Nodes {
+		if node.Status != expected[node.WorkflowNode] {
+			t.Errorf("node %s: expected %s, got %s\n", node.WorkflowNode, expected[node.WorkflowNode], node.Status)
+		}
+	}
+}
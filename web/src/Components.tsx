@@ -51,6 +51,13 @@ function CommandList() {
 							command.status,
 						);
 						break;
+					case CommandEventType.PROGRESS:
+						setCommandStore(
+							(c) => c.id === command.id,
+							"progress",
+							command.progress,
+						);
+						break;
 					case CommandEventType.DELETE:
 						setCommandStore((prev) => prev.filter((c) => c.id !== command.id));
 						break;
@@ -75,6 +82,12 @@ function CommandList() {
 							href={`/${c.id}`}
 						>
 							{c.command}
+							{c.progress?.percent != null && (
+								<span class="text-neutral-400">
+									{" "}
+									{c.progress.percent.toFixed(0)}%
+								</span>
+							)}
 						</A>
 					))}
 				</div>
@@ -112,7 +125,12 @@ const LogList: Component<LogListProps> = ({ id }) => {
 			const prevLogs = await fetcher([]);
 			setLogs(prevLogs);
 			for await (const log of stream().iterator) {
-				setLogs((prevLogs) => [log, ...prevLogs]);
+				// partial and progress lines are sent again with the same id
+				setLogs((prevLogs) => {
+					const idx = prevLogs.findIndex((prev) => prev.id === log.id);
+					if (idx === -1) return [log, ...prevLogs];
+					return prevLogs.with(idx, log);
+				});
 			}
 		})();
 	});
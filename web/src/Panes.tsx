@@ -48,7 +48,11 @@ const CommandPane = () => {
 	);
 	const statusOk = () =>
 		command()?.status === CommandStatus.EXITED ||
-		command()?.status === CommandStatus.ERROR;
+		command()?.status === CommandStatus.ERROR ||
+		command()?.status === CommandStatus.TIMED_OUT ||
+		command()?.status === CommandStatus.LOST ||
+		command()?.status === CommandStatus.CANCELED ||
+		command()?.status === CommandStatus.SKIPPED;
 
 	const handleDelete = () => {
 		api
@@ -3,18 +3,27 @@ enum CommandStatus {
 	RUNNING = "RUNNING",
 	EXITED = "EXITED",
 	ERROR = "ERROR",
+	TIMED_OUT = "TIMED_OUT",
+	LOST = "LOST",
+	QUEUED = "QUEUED",
+	CANCELED = "CANCELED",
+	PAUSED = "PAUSED",
+	PENDING = "PENDING",
+	SKIPPED = "SKIPPED",
 }
 
 enum CommandEventType {
 	CREATE = "create",
 	UPDATE = "update",
 	DELETE = "delete",
+	PROGRESS = "progress",
 }
 
 enum LogFD {
 	STDOUT = 1,
 	STDERR = 2,
 	ERROR = -1,
+	STDIN = 0,
 }
 
 type Command = {
@@ -22,12 +31,192 @@ type Command = {
 	createdAt: string;
 	command: string;
 	status: CommandStatus;
+	exitCode: number | null;
+	termSignal: number | null;
+	startedAt: string | null;
+	finishedAt: string | null;
+	durationMs: number | null;
+	timeoutMs: number | null;
+	deadline: string | null;
+	cwd: string;
+	env: Record<string, string> | null;
+	pid: number | null;
+	pgid: number | null;
+	queue: string;
+	queuePosition: number | null;
+	rerunOf: string | null;
+	retry: RetryPolicy | null;
+	attempt: number;
+	tty: boolean;
+	ttyRows: number | null;
+	ttyCols: number | null;
+	stdin: boolean;
+	peakRss: number | null;
+	limits: Limits | null;
+	termReason: "stopped" | "timeout" | "oom" | null;
+	exec: ExecSpec | null;
+	workflowId: string | null;
+	workflowNode: string;
+	dependsOn: Dependency[] | null;
+	templateId: string | null;
+	// exempt from the retention policy
+	pinned: boolean;
+	// when a PENDING retry attempt is released
+	retryAt: string | null;
+	// only known from progress events while the command runs
+	progress?: Progress;
+};
+
+type Progress = {
+	parser: string;
+	percent: number | null;
+	// bytes per second, or a multiple of realtime when rateUnit is "x"
+	rate: number | null;
+	rateUnit: string;
+	etaMs: number | null;
+};
+
+type Limits = {
+	memoryBytes: number;
+	cpus: number;
+	maxProcesses: number;
+	maxOpenFiles: number;
+	nice: number | null;
+	ioClass: "" | "realtime" | "best-effort" | "idle";
+	ioPriority: number | null;
+};
+
+type ExecSpec = {
+	mode: "shell" | "argv" | "script";
+	shell: string;
+	argv: string[] | null;
+	interpreter: string[] | null;
+};
+
+type RetryPolicy = {
+	maxAttempts: number;
+	backoff: "fixed" | "exponential";
+	delayMs: number;
+	maxDelayMs: number;
+	onFailure: boolean;
+	exitCodes: number[] | null;
+	onTimeout: boolean;
+};
+
+type ResourceSample = {
+	id: string;
+	commandId: string;
+	createdAt: string;
+	cpuPercent: number;
+	rssBytes: number;
+	readBytes: number;
+	writeBytes: number;
+	threads: number;
+	processes: number;
+};
+
+// counters of /api/v1/log/stats since the server started
+type LogStats = {
+	queued: number;
+	written: number;
+	batches: number;
+	blocked: number;
+	dropped: number;
+	failed: number;
+};
+
+// every rule is off while null, pinned commands are never pruned
+type RetentionPolicy = {
+	maxAgeDays: number | null;
+	maxLogLines: number | null;
+	maxLogBytes: number | null;
+	keepFinished: number | null;
+};
+
+type RetentionReport = {
+	startedAt: string;
+	durationMs: number;
+	deletedCommands: number;
+	trimmedCommands: number;
+	deletedLogs: number;
+	deletedBytes: number;
+};
+
+// response of GET /api/v1/retention
+type RetentionInfo = {
+	policy: RetentionPolicy;
+	lastReport: RetentionReport | null;
+};
+
+type SnippetPart = {
+	text: string;
+	// a matched term
+	match: boolean;
+};
+
+// item of GET /api/v1/search, newest first
+type SearchResult = {
+	kind: "command" | "log";
+	// id of the command or log, pass the last one as `before` for the next page
+	id: string;
+	commandId: string;
+	createdAt: string;
+	command: string;
+	status: CommandStatus;
+	// only set for logs
+	fd: number | null;
+	snippet: SnippetPart[];
+};
+
+// response of POST /api/v1/db/vacuum, sizes in bytes
+type VacuumResult = {
+	sizeBefore: number;
+	sizeAfter: number;
+	durationMs: number;
 };
 
 type CommandEvent = Command & {
 	type: CommandEventType;
 };
 
+type Dependency = {
+	node: string;
+	condition: "success" | "failure" | "always";
+};
+
+type Workflow = {
+	id: string;
+	createdAt: string;
+	name: string;
+	status: "RUNNING" | "SUCCEEDED" | "FAILED" | "CANCELED";
+	finishedAt: string | null;
+	// latest attempt of each node
+	nodes: Command[];
+};
+
+type TemplateParam = {
+	name: string;
+	type: "string" | "int" | "float" | "bool" | "path";
+	// null when the parameter is required
+	default: string | null;
+};
+
+type Template = {
+	id: string;
+	createdAt: string;
+	name: string;
+	description: string;
+	// command line with placeholders like `{{crf:int=23}}`
+	command: string;
+	// options of the commands run from the template
+	spec: Record<string, unknown>;
+	params: TemplateParam[];
+};
+
+type WorkflowEvent = Workflow & {
+	type: CommandEventType.CREATE | CommandEventType.UPDATE;
+};
+
 type Log = {
 	id: string;
 	commandId: string;
@@ -36,5 +225,31 @@ type Log = {
 	fd: LogFD;
 };
 
-export type { Log, Command, LogFD, CommandEvent };
+// text frames of /api/v1/command/:id/terminal, binary frames carry raw bytes
+type TerminalMessage =
+	| { type: "resize"; rows: number; cols: number }
+	| { type: "close" }
+	| { type: "exit"; command: Command }
+	| { type: "error"; error: string };
+
+export type {
+	Log,
+	Command,
+	LogFD,
+	CommandEvent,
+	Progress,
+	ResourceSample,
+	TerminalMessage,
+	Workflow,
+	WorkflowEvent,
+	Template,
+	TemplateParam,
+	LogStats,
+	VacuumResult,
+	RetentionPolicy,
+	RetentionReport,
+	RetentionInfo,
+	SnippetPart,
+	SearchResult,
+};
 export { CommandEventType, CommandStatus };